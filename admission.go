@@ -0,0 +1,144 @@
+package rua
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reasons of rejected connections.
+var (
+	ErrIpDenied            = errors.New("ip denied")
+	ErrAcceptRateExceeded  = errors.New("accept rate exceeded")
+	ErrMaxConnections      = errors.New("too many connections")
+	ErrMaxConnectionsPerIp = errors.New("too many connections from the same ip")
+	ErrRejectedByGuardian  = errors.New("rejected by guardian")
+)
+
+type admission struct {
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	maxConns   int
+	maxConnsIp int
+	ratePerSec float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+	guardian   func(net.Conn) bool
+	conns      int
+	connsPerIp map[string]int
+	lock       *sync.Mutex
+}
+
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// treat a single ip as a /32 or /128 network
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid cidr: " + cidr)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+func matchCidrs(ip net.IP, cidrs []*net.IPNet) bool {
+	for _, c := range cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIp(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Return nil if the connection is admitted, and the connection will be counted.
+func (a *admission) admit(conn net.Conn) error {
+	ip := remoteIp(conn.RemoteAddr())
+	if ip != nil {
+		if matchCidrs(ip, a.deny) {
+			return ErrIpDenied
+		}
+		if len(a.allow) != 0 && !matchCidrs(ip, a.allow) {
+			return ErrIpDenied
+		}
+	}
+
+	key := ip.String()
+
+	// reserve the slot before calling the guardian, so concurrent connections can't exceed the limits
+	a.lock.Lock()
+	if a.ratePerSec > 0 {
+		now := time.Now()
+		a.tokens += now.Sub(a.lastRefill).Seconds() * a.ratePerSec
+		if a.tokens > a.burst {
+			a.tokens = a.burst
+		}
+		a.lastRefill = now
+		if a.tokens < 1 {
+			a.lock.Unlock()
+			return ErrAcceptRateExceeded
+		}
+		a.tokens -= 1
+	}
+	if a.maxConns > 0 && a.conns >= a.maxConns {
+		a.lock.Unlock()
+		return ErrMaxConnections
+	}
+	if a.maxConnsIp > 0 && a.connsPerIp[key] >= a.maxConnsIp {
+		a.lock.Unlock()
+		return ErrMaxConnectionsPerIp
+	}
+	a.conns += 1
+	a.connsPerIp[key] += 1
+	a.lock.Unlock()
+
+	if a.guardian != nil && !a.guardian(conn) {
+		a.release(key)
+		return ErrRejectedByGuardian
+	}
+	return nil
+}
+
+func (a *admission) release(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.conns -= 1
+	if a.connsPerIp[key] <= 1 {
+		delete(a.connsPerIp, key)
+	} else {
+		a.connsPerIp[key] -= 1
+	}
+}
+
+// Return a function which releases the admitted connection, only the first call works.
+func (a *admission) releaser(conn net.Conn) func() {
+	key := remoteIp(conn.RemoteAddr()).String()
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			a.release(key)
+		})
+	}
+}
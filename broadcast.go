@@ -94,6 +94,7 @@ func (b *Broadcaster) innerWrite(data []byte, timeoutMs uint64, callback func(er
 	go func() {
 		b.lock.Lock()
 		for id, target := range b.targets {
+			id := id
 			_callback := func(err error) {
 				if err != nil && !b.keepDeadTargets {
 					go func() {
@@ -0,0 +1,217 @@
+package rua
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+)
+
+// Codec splits a byte stream into frames and encodes frames into a byte stream.
+// A codec should be stateless so it can be shared by many nodes.
+type Codec interface {
+	// Read the next frame. Frames larger than `maxSize` should be rejected, 0 means no limit.
+	// Length-prefixed codecs always reject frames larger than `math.MaxInt32`.
+	ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error)
+	// Encode a frame into buffers which will be written in order.
+	EncodeFrame(data []byte, maxSize int) (net.Buffers, error)
+}
+
+var errFrameTooLarge = errors.New("frame too large")
+
+type delimiterCodec struct {
+	delimiter []byte
+	trimCR    bool
+}
+
+// Frames are separated by `\n`, a trailing `\r` will be removed when reading.
+func LineCodec() Codec {
+	return &delimiterCodec{delimiter: []byte{'\n'}, trimCR: true}
+}
+
+// Frames are separated by the delimiter.
+func DelimiterCodec(delimiter []byte) Codec {
+	return &delimiterCodec{delimiter: delimiter, trimCR: false}
+}
+
+func (c *delimiterCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	if len(c.delimiter) == 0 {
+		return nil, errors.New("empty delimiter")
+	}
+
+	last := c.delimiter[len(c.delimiter)-1]
+	frame := []byte{}
+	for {
+		chunk, err := r.ReadSlice(last)
+		frame = append(frame, chunk...)
+		if err == nil && bytes.HasSuffix(frame, c.delimiter) {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if maxSize != 0 && len(frame) > maxSize+len(c.delimiter) {
+			return nil, errFrameTooLarge
+		}
+	}
+
+	frame = frame[:len(frame)-len(c.delimiter)]
+	if c.trimCR && len(frame) != 0 && frame[len(frame)-1] == '\r' {
+		frame = frame[:len(frame)-1]
+	}
+	if maxSize != 0 && len(frame) > maxSize {
+		return nil, errFrameTooLarge
+	}
+	return frame, nil
+}
+
+func (c *delimiterCodec) EncodeFrame(data []byte, maxSize int) (net.Buffers, error) {
+	if maxSize != 0 && len(data) > maxSize {
+		return nil, errFrameTooLarge
+	}
+	return net.Buffers{data, c.delimiter}, nil
+}
+
+type lengthPrefixCodec struct {
+	prefixSize int // 2 or 4
+	order      binary.ByteOrder
+}
+
+// Each frame is prefixed with its length as an uint16.
+func Uint16PrefixCodec(order binary.ByteOrder) Codec {
+	return &lengthPrefixCodec{prefixSize: 2, order: order}
+}
+
+// Each frame is prefixed with its length as an uint32.
+func Uint32PrefixCodec(order binary.ByteOrder) Codec {
+	return &lengthPrefixCodec{prefixSize: 4, order: order}
+}
+
+func (c *lengthPrefixCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	prefix := make([]byte, c.prefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	var length uint64
+	if c.prefixSize == 2 {
+		length = uint64(c.order.Uint16(prefix))
+	} else {
+		length = uint64(c.order.Uint32(prefix))
+	}
+	return readFrameBody(r, length, maxSize)
+}
+
+func (c *lengthPrefixCodec) EncodeFrame(data []byte, maxSize int) (net.Buffers, error) {
+	if maxSize != 0 && len(data) > maxSize {
+		return nil, errFrameTooLarge
+	}
+
+	prefix := make([]byte, c.prefixSize)
+	if c.prefixSize == 2 {
+		if len(data) > 0xffff {
+			return nil, errFrameTooLarge
+		}
+		c.order.PutUint16(prefix, uint16(len(data)))
+	} else {
+		if uint64(len(data)) > 0xffffffff {
+			return nil, errFrameTooLarge
+		}
+		c.order.PutUint32(prefix, uint32(len(data)))
+	}
+	return net.Buffers{prefix, data}, nil
+}
+
+type varintPrefixCodec struct{}
+
+// Each frame is prefixed with its length as an unsigned varint.
+func VarintPrefixCodec() Codec {
+	return &varintPrefixCodec{}
+}
+
+func (c *varintPrefixCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	return readFrameBody(r, length, maxSize)
+}
+
+func (c *varintPrefixCodec) EncodeFrame(data []byte, maxSize int) (net.Buffers, error) {
+	if maxSize != 0 && len(data) > maxSize {
+		return nil, errFrameTooLarge
+	}
+
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(data)))
+	return net.Buffers{prefix[:n], data}, nil
+}
+
+// Lengths above this are rejected even if there is no max frame size.
+const maxFrameLength = math.MaxInt32
+
+// Read the body in chunks, so a forged length can't allocate more memory than the data actually received.
+func readFrameBody(r *bufio.Reader, length uint64, maxSize int) ([]byte, error) {
+	if length > maxFrameLength || (maxSize != 0 && length > uint64(maxSize)) {
+		return nil, errFrameTooLarge
+	}
+
+	const chunkSize = 64 * 1024
+	initial := length
+	if initial > chunkSize {
+		initial = chunkSize
+	}
+	frame := make([]byte, 0, initial)
+	for uint64(len(frame)) < length {
+		n := length - uint64(len(frame))
+		if n > chunkSize {
+			n = chunkSize
+		}
+		start := len(frame)
+		frame = append(frame, make([]byte, n)...)
+		if _, err := io.ReadFull(r, frame[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+type rawCodec struct {
+	chunkSize int
+}
+
+// No framing, each read returns at most `chunkSize` bytes which are currently available,
+// and data is written as is.
+func RawCodec(chunkSize int) Codec {
+	return &rawCodec{chunkSize: chunkSize}
+}
+
+func (c *rawCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	size := c.chunkSize
+	if maxSize != 0 && (size <= 0 || size > maxSize) {
+		size = maxSize
+	}
+	if size <= 0 {
+		size = 4096
+	}
+
+	buf := make([]byte, size)
+	n, err := r.Read(buf)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (c *rawCodec) EncodeFrame(data []byte, maxSize int) (net.Buffers, error) {
+	if maxSize != 0 && len(data) > maxSize {
+		return nil, errFrameTooLarge
+	}
+	return net.Buffers{data}, nil
+}
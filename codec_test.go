@@ -0,0 +1,135 @@
+package rua
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := map[string]Codec{
+		"line":      LineCodec(),
+		"delimiter": DelimiterCodec([]byte("\r\n\r\n")),
+		"uint16":    Uint16PrefixCodec(binary.BigEndian),
+		"uint32":    Uint32PrefixCodec(binary.LittleEndian),
+		"varint":    VarintPrefixCodec(),
+	}
+	frames := [][]byte{
+		[]byte("hello"),
+		{},
+		[]byte("world"),
+		bytes.Repeat([]byte("a"), 70000), // larger than the bufio buffer and a read chunk
+		{},
+	}
+
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			stream := &bytes.Buffer{}
+			for _, frame := range frames {
+				if name == "uint16" && len(frame) > 0xffff {
+					if _, err := c.EncodeFrame(frame, 0); err != errFrameTooLarge {
+						t.Fatalf("encode %d bytes: want errFrameTooLarge, got %v", len(frame), err)
+					}
+					continue
+				}
+				buffers, err := c.EncodeFrame(frame, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				buffers.WriteTo(stream)
+			}
+
+			r := bufio.NewReader(stream)
+			for _, frame := range frames {
+				if name == "uint16" && len(frame) > 0xffff {
+					continue
+				}
+				got, err := c.ReadFrame(r, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, frame) {
+					t.Fatalf("want %d bytes, got %d bytes", len(frame), len(got))
+				}
+			}
+			if _, err := c.ReadFrame(r, 0); err != io.EOF {
+				t.Fatalf("want io.EOF at the end, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCodecMaxSize(t *testing.T) {
+	codecs := map[string]Codec{
+		"line":   LineCodec(),
+		"uint16": Uint16PrefixCodec(binary.BigEndian),
+		"uint32": Uint32PrefixCodec(binary.BigEndian),
+		"varint": VarintPrefixCodec(),
+		"raw":    RawCodec(0),
+	}
+
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := c.EncodeFrame([]byte("12345"), 4); err != errFrameTooLarge {
+				t.Fatalf("encode: want errFrameTooLarge, got %v", err)
+			}
+			if _, err := c.EncodeFrame([]byte("1234"), 4); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			stream := &bytes.Buffer{}
+			buffers, _ := c.EncodeFrame([]byte("12345"), 0)
+			buffers.WriteTo(stream)
+			got, err := c.ReadFrame(bufio.NewReader(stream), 4)
+			if name == "raw" {
+				// raw reads are split instead of rejected
+				if err != nil || string(got) != "1234" {
+					t.Fatalf("want 1234, got %q, %v", got, err)
+				}
+				return
+			}
+			if err != errFrameTooLarge {
+				t.Fatalf("read: want errFrameTooLarge, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCodecForgedLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		input []byte
+		want  error
+	}{
+		{"varint overflow", VarintPrefixCodec(), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, errFrameTooLarge},
+		{"uint32 max", Uint32PrefixCodec(binary.BigEndian), []byte{0xff, 0xff, 0xff, 0xff}, errFrameTooLarge},
+		{"uint32 truncated body", Uint32PrefixCodec(binary.BigEndian), []byte{0x10, 0, 0, 0, 'a'}, io.ErrUnexpectedEOF},
+		{"uint16 truncated body", Uint16PrefixCodec(binary.BigEndian), []byte{0, 3, 'a'}, io.ErrUnexpectedEOF},
+		{"uint16 truncated prefix", Uint16PrefixCodec(binary.BigEndian), []byte{0}, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.codec.ReadFrame(bufio.NewReader(bytes.NewReader(tt.input)), 0)
+			if err != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLineCodecTrimCR(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("a\r\n\nb\r\r\n")))
+	for _, want := range []string{"a", "", "b\r"} {
+		got, err := LineCodec().ReadFrame(r, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	}
+}
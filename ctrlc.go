@@ -2,19 +2,20 @@ package rua
 
 import (
 	"os"
-	"os/signal"
 )
 
+// Handle the first `os.Interrupt` signal. See `SignalNode` for more signals.
 type Ctrlc struct {
-	handle        *StopOnlyHandle
-	stopRx        chan *StopPayload
+	node          *SignalNode
 	signalHandler func()
 }
 
 func NewCtrlc() *Ctrlc {
-	stopChan := make(chan *StopPayload)
-	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
-	return &Ctrlc{signalHandler: func() {}, stopRx: stopChan, handle: handle}
+	c := &Ctrlc{signalHandler: func() {}}
+	c.node = NewSignalNode().Once(true).On(os.Interrupt, func(os.Signal) {
+		c.signalHandler()
+	})
+	return c
 }
 
 func (c *Ctrlc) OnSignal(handler func()) *Ctrlc {
@@ -23,21 +24,15 @@ func (c *Ctrlc) OnSignal(handler func()) *Ctrlc {
 }
 
 func (c *Ctrlc) Handle() *StopOnlyHandle {
-	return c.handle
+	return c.node.Handle()
 }
 
 func (c Ctrlc) Go() *StopOnlyHandle {
-	go func() {
-		c.Wait()
-	}()
-	return c.handle
+	handle, _ := c.node.Go()
+	return handle
 }
 
+// Block until the signal is handled or the node is stopped.
 func (c Ctrlc) Wait() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	for range ch {
-		c.signalHandler()
-		break
-	}
+	c.node.Wait()
 }
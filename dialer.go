@@ -0,0 +1,344 @@
+package rua
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+type DisconnectedWritePolicy int
+
+const (
+	// Keep writes until the connection is established, at most `maxPending` writes.
+	BufferWhenDisconnected DisconnectedWritePolicy = iota
+	// Fail writes immediately when disconnected.
+	FailWhenDisconnected
+)
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+type readResult struct {
+	gen uint64
+	err error
+}
+
+// TcpDialer connects to a remote address and reconnects automatically.
+// The handle is stable across reconnections.
+type TcpDialer struct {
+	addr              string
+	tlsConfig         *tls.Config
+	dialTimeoutMs     uint64
+	writeTimeoutMs    uint64
+	minBackoffMs      uint64
+	maxBackoffMs      uint64
+	backoffFactor     float64
+	jitter            float64
+	codec             Codec
+	maxFrameSize      int
+	writePolicy       DisconnectedWritePolicy
+	maxPending        int
+	inputHandler      func([]byte)
+	connectHandler    func(net.Conn)
+	disconnectHandler func(error)
+	dialErrorHandler  func(error)
+	handle            *Handle
+	rx                chan *WritePayload
+	stopRx            chan *StopPayload
+}
+
+func NewTcpDialer(addr string, buffer uint) *TcpDialer {
+	msgChan := make(chan *WritePayload, buffer)
+	stopChan := make(chan *StopPayload)
+
+	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
+	return &TcpDialer{
+		addr:              addr,
+		tlsConfig:         nil,
+		dialTimeoutMs:     5000,
+		writeTimeoutMs:    10000,
+		minBackoffMs:      100,
+		maxBackoffMs:      30000,
+		backoffFactor:     2,
+		jitter:            0.2,
+		codec:             LineCodec(),
+		maxFrameSize:      0,
+		writePolicy:       BufferWhenDisconnected,
+		maxPending:        1024,
+		inputHandler:      func([]byte) {},
+		connectHandler:    func(net.Conn) {},
+		disconnectHandler: func(error) {},
+		dialErrorHandler:  func(error) {},
+		handle:            handle,
+		rx:                msgChan,
+		stopRx:            stopChan,
+	}
+}
+
+func DefaultTcpDialer(addr string) *TcpDialer {
+	return NewTcpDialer(addr, 16)
+}
+
+// Connect with TLS.
+func (d *TcpDialer) TLSConfig(config *tls.Config) *TcpDialer {
+	d.tlsConfig = config
+	return d
+}
+
+// Default is 5000, 0 means no timeout.
+func (d *TcpDialer) DialTimeoutMs(ms uint64) *TcpDialer {
+	d.dialTimeoutMs = ms
+	return d
+}
+
+// A write which can't finish in time breaks the connection, so a peer which stops reading
+// can't block the dialer. Default is 10000, 0 means no timeout.
+func (d *TcpDialer) WriteTimeoutMs(ms uint64) *TcpDialer {
+	d.writeTimeoutMs = ms
+	return d
+}
+
+// The delay before reconnecting starts from `minMs` and is multiplied by the backoff factor after each failure,
+// until it reaches `maxMs`. Default is 100 and 30000.
+// A connection which is closed within `maxMs` also counts as a failure, so a server which closes
+// connections immediately won't cause a reconnect loop.
+func (d *TcpDialer) Backoff(minMs, maxMs uint64) *TcpDialer {
+	d.minBackoffMs = minMs
+	d.maxBackoffMs = maxMs
+	return d
+}
+
+// Default is 2.
+func (d *TcpDialer) BackoffFactor(factor float64) *TcpDialer {
+	d.backoffFactor = factor
+	return d
+}
+
+// Randomize the delay by the ratio, e.g. 0.2 means +-20%. Default is 0.2.
+func (d *TcpDialer) Jitter(ratio float64) *TcpDialer {
+	d.jitter = ratio
+	return d
+}
+
+// Set the framing codec. Default is `LineCodec`.
+func (d *TcpDialer) Codec(c Codec) *TcpDialer {
+	d.codec = c
+	return d
+}
+
+// Default is 0 which means no limit.
+func (d *TcpDialer) MaxFrameSize(size int) *TcpDialer {
+	d.maxFrameSize = size
+	return d
+}
+
+// Default is `BufferWhenDisconnected`.
+func (d *TcpDialer) WritePolicy(p DisconnectedWritePolicy) *TcpDialer {
+	d.writePolicy = p
+	return d
+}
+
+// Max buffered writes when using `BufferWhenDisconnected`, extra writes will fail. Default is 1024, 0 means no limit.
+// A write which breaks the connection is buffered again only if there is room.
+func (d *TcpDialer) MaxPendingWrites(n int) *TcpDialer {
+	d.maxPending = n
+	return d
+}
+
+func (d *TcpDialer) OnInput(f func([]byte)) *TcpDialer {
+	d.inputHandler = f
+	return d
+}
+
+func (d *TcpDialer) OnConnect(f func(net.Conn)) *TcpDialer {
+	d.connectHandler = f
+	return d
+}
+
+// The handler will get the error which caused the disconnection.
+func (d *TcpDialer) OnDisconnect(f func(error)) *TcpDialer {
+	d.disconnectHandler = f
+	return d
+}
+
+func (d *TcpDialer) OnDialError(f func(error)) *TcpDialer {
+	d.dialErrorHandler = f
+	return d
+}
+
+func (d *TcpDialer) Handle() *Handle {
+	return d.handle
+}
+
+// Return the delay before the next dial. `failures` is the number of consecutive failures.
+func (d *TcpDialer) backoff(failures int) time.Duration {
+	ms := float64(d.minBackoffMs) * math.Pow(d.backoffFactor, float64(failures))
+	if ms > float64(d.maxBackoffMs) {
+		ms = float64(d.maxBackoffMs)
+	}
+	ms *= 1 + d.jitter*(2*rand.Float64()-1)
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (d *TcpDialer) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(d.dialTimeoutMs) * time.Millisecond}
+	if d.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", d.addr, d.tlsConfig)
+	}
+	return dialer.Dial("tcp", d.addr)
+}
+
+// Return error if missing `addr`.
+func (d *TcpDialer) Go() (*Handle, error) {
+	if len(d.addr) == 0 {
+		return nil, errors.New("missing addr")
+	}
+
+	go func() {
+		var conn net.Conn = nil
+		var gen uint64 = 0 // increase for each connection
+		var retryTimer *time.Timer = nil
+		var retryC <-chan time.Time = nil
+		var connectedAt time.Time
+		failures := 0
+		pending := []*WritePayload{}
+		dialChan := make(chan *dialResult)
+		readChan := make(chan *readResult)
+		stopped := make(chan bool)
+		defer close(stopped)
+
+		startDial := func() {
+			go func() {
+				c, err := d.dial()
+				select {
+				case dialChan <- &dialResult{conn: c, err: err}:
+				case <-stopped:
+					if c != nil {
+						c.Close()
+					}
+				}
+			}()
+		}
+
+		scheduleDial := func(delay time.Duration) {
+			retryTimer = time.NewTimer(delay)
+			retryC = retryTimer.C
+		}
+
+		disconnect := func(err error) {
+			conn.Close()
+			conn = nil
+			gen += 1
+			d.disconnectHandler(err)
+			if time.Since(connectedAt) >= time.Duration(d.maxBackoffMs)*time.Millisecond {
+				failures = 0
+			} else {
+				failures += 1
+			}
+			scheduleDial(d.backoff(failures))
+		}
+
+		// Return false if the connection is broken.
+		write := func(payload *WritePayload) bool {
+			buffers, err := d.codec.EncodeFrame(payload.Data, d.maxFrameSize)
+			if err != nil {
+				payload.Callback(err)
+				return true
+			}
+			if d.writeTimeoutMs != 0 {
+				conn.SetWriteDeadline(time.Now().Add(time.Duration(d.writeTimeoutMs) * time.Millisecond))
+			}
+			if _, err = buffers.WriteTo(conn); err != nil {
+				if d.writePolicy == BufferWhenDisconnected && (d.maxPending == 0 || len(pending) < d.maxPending) {
+					pending = append([]*WritePayload{payload}, pending...)
+				} else {
+					payload.Callback(err)
+				}
+				disconnect(err)
+				return false
+			}
+			payload.Callback(nil)
+			return true
+		}
+
+		startDial()
+
+		loop := true
+		for loop {
+			select {
+			case r := <-dialChan:
+				if r.err != nil {
+					failures += 1
+					d.dialErrorHandler(r.err)
+					scheduleDial(d.backoff(failures))
+					break
+				}
+
+				conn = r.conn
+				connectedAt = time.Now()
+				gen += 1
+				d.connectHandler(conn)
+
+				// reader thread
+				go func(c net.Conn, g uint64) {
+					reader := bufio.NewReader(c)
+					for {
+						frame, err := d.codec.ReadFrame(reader, d.maxFrameSize)
+						if err != nil {
+							select {
+							case readChan <- &readResult{gen: g, err: err}:
+							case <-stopped:
+							}
+							return
+						}
+						d.inputHandler(frame)
+					}
+				}(conn, gen)
+
+				// flush pending writes
+				for len(pending) != 0 && conn != nil {
+					payload := pending[0]
+					pending = pending[1:]
+					write(payload)
+				}
+			case <-retryC:
+				retryC = nil
+				startDial()
+			case r := <-readChan:
+				if r.gen == gen && conn != nil {
+					disconnect(r.err)
+				}
+			case payload := <-d.rx:
+				if conn != nil {
+					write(payload)
+				} else if d.writePolicy == FailWhenDisconnected {
+					payload.Callback(errors.New("disconnected"))
+				} else if d.maxPending != 0 && len(pending) >= d.maxPending {
+					payload.Callback(errors.New("too many pending writes"))
+				} else {
+					pending = append(pending, payload)
+				}
+			case payload := <-d.stopRx:
+				if retryTimer != nil {
+					retryTimer.Stop()
+				}
+				if conn != nil {
+					conn.Close()
+				}
+				for _, p := range pending {
+					p.Callback(errors.New("dialer stopped"))
+				}
+				payload.Callback(nil)
+				loop = false
+			}
+		}
+	}()
+
+	return d.handle, nil
+}
@@ -0,0 +1,118 @@
+package rua
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTcpDialerBackoff(t *testing.T) {
+	d := NewTcpDialer("127.0.0.1:1", 0).Backoff(100, 1000).BackoffFactor(2).Jitter(0)
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for failures, ms := range want {
+		if got := d.backoff(failures); got != ms*time.Millisecond {
+			t.Errorf("failures %d: want %v, got %v", failures, ms*time.Millisecond, got)
+		}
+	}
+
+	d.Jitter(0.2)
+	for i := 0; i < 100; i++ {
+		if got := d.backoff(0); got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("want 80ms to 120ms, got %v", got)
+		}
+	}
+}
+
+func TestTcpDialerBacksOffWhenClosedImmediately(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32 = 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	// delays are 20, 40, 80, 160, 320ms
+	h, _ := DefaultTcpDialer(ln.Addr().String()).Backoff(20, 1000).Jitter(0).Go()
+	time.Sleep(500 * time.Millisecond)
+	h.Stop()
+	if n := atomic.LoadInt32(&accepted); n < 2 || n > 6 {
+		t.Fatalf("want 2 to 6 connections, got %d", n)
+	}
+}
+
+// Return an address which nothing listens on yet.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestTcpDialerFailWhenDisconnected(t *testing.T) {
+	h, _ := DefaultTcpDialer(freeAddr(t)).WritePolicy(FailWhenDisconnected).Go()
+	defer h.Stop()
+
+	result := make(chan error, 1)
+	h.WriteThen([]byte("hello"), func(err error) { result <- err })
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("want error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestTcpDialerBufferWhenDisconnected(t *testing.T) {
+	addr := freeAddr(t)
+	h, _ := DefaultTcpDialer(addr).Backoff(10, 50).MaxPendingWrites(1).Go()
+	defer h.Stop()
+
+	// only one of the writes can be buffered
+	results := make(chan error, 2)
+	h.WriteThen([]byte("a"), func(err error) { results <- err })
+	h.WriteThen([]byte("b"), func(err error) { results <- err })
+	select {
+	case err := <-results:
+		if err == nil || err.Error() != "too many pending writes" {
+			t.Fatalf("want too many pending writes, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("the address is taken: ", err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || (line != "a\n" && line != "b\n") {
+		t.Fatalf("want the buffered write, got %q, %v", line, err)
+	}
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+}
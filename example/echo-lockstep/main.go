@@ -2,33 +2,28 @@ package main
 
 import (
 	"strconv"
-	"sync"
 
 	"github.com/DiscreteTom/rua"
 )
 
 func main() {
-	lock := &sync.Mutex{}
-	state := []byte{}
+	stdio_node := rua.DefaultStdioNode()
+	stdio := stdio_node.Handle()
 
-	stdio := rua.DefaultStdioNode().OnInput(func(b []byte) {
-		lock.Lock()
-		defer lock.Unlock()
-		state = append(state, b...)
-	}).Go()
-
-	ls, _ := rua.DefaultTicker().OnTick(func(u uint64) {
-		lock.Lock()
-		defer lock.Unlock()
+	ls, _ := rua.NewLockstepNode(1000).OnStep(func(frame *rua.LockstepFrame) {
 		// construct output
 		buffer := []byte{}
-		buffer = append(buffer, []byte(strconv.FormatUint(u, 10))...)
-		buffer = append(buffer, []byte("\n")...)
-		buffer = append(buffer, state...)
+		buffer = append(buffer, []byte(strconv.FormatUint(frame.Tick, 10))...)
+		for _, input := range frame.Inputs {
+			buffer = append(buffer, []byte("\n")...)
+			buffer = append(buffer, input.Data...)
+		}
 		// write
 		stdio.Write(buffer)
-		// reset state
-		state = []byte{}
+	}).Go()
+
+	stdio_node.OnInput(func(b []byte) {
+		ls.Input(0, b)
 	}).Go()
 
 	rua.NewCtrlc().OnSignal(func() {
@@ -8,7 +8,12 @@ import (
 )
 
 func main() {
-	file, err := rua.DefaultFileNode().Filename("log.txt").Go()
+	file, err := rua.DefaultFileNode().
+		Filename("log.txt").
+		MaxSize(1 << 20).
+		MaxBackups(3).
+		Compress(true).
+		Go()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -18,8 +23,12 @@ func main() {
 		file.Write(b)
 	}).Go()
 
-	rua.NewCtrlc().OnSignal(func() {
-		file.Stop()
-		stdio.Stop()
-	}).Wait()
+	// stop the input first, then the file
+	report := rua.NewShutdown().
+		Register(0, "stdio", stdio).
+		Register(1, "file", file).
+		Wait()
+	for _, f := range report.Failures {
+		fmt.Println(f.Name, f.Err)
+	}
 }
@@ -6,7 +6,7 @@ func main() {
 	bc := rua.NewBroadcaster()
 
 	// start tcp listener
-	tcp, _ := rua.NewTcpListener("127.0.0.1:8080").OnNewPeer(func(tn *rua.TcpNode) {
+	tcp, _ := rua.NewTcpListener("127.0.0.1:8080").StopPeers(true).OnNewPeer(func(tn *rua.TcpNode) {
 		// new peer will be added to the broadcaster
 		bc.AddTarget(tn.OnInput(func(b []byte) {
 			// new message will be sent to the broadcaster
@@ -15,10 +15,12 @@ func main() {
 	}).Go()
 
 	// also print to stdout
-	bc.AddTarget(rua.DefaultStdioNode().Go())
+	stdio := rua.DefaultStdioNode().Go()
+	bc.AddTarget(stdio)
 
-	rua.NewCtrlc().OnSignal(func() {
-		bc.StopAll()
-		tcp.Stop()
-	}).Wait()
+	// stop the listener and its peers first, then stdout
+	rua.NewShutdown().
+		Register(0, "tcp", tcp).
+		Register(1, "stdio", stdio).
+		Wait()
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DiscreteTom/rua"
+)
+
+func main() {
+	log, err := rua.DefaultLogNode("wal").SyncPolicy(rua.SyncGroupCommit).Go()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// print existing records before accepting new input
+	done := make(chan bool)
+	log.ReplayThen(0, func(offset uint64, data []byte) {
+		fmt.Printf("%d: %s\n", offset, data)
+	}, func(next uint64, err error) {
+		if err != nil {
+			fmt.Println(err)
+		}
+		close(done)
+	})
+	<-done
+
+	stdio := rua.DefaultStdioNode().OnInput(func(b []byte) {
+		log.AppendThen(b, func(offset uint64, err error) {
+			if err == nil {
+				fmt.Println("appended at", offset)
+			}
+		})
+	}).Go()
+
+	rua.NewShutdown().
+		Register(0, "stdio", stdio).
+		Register(1, "log", log).
+		Wait()
+}
@@ -3,25 +3,95 @@ package rua
 import (
 	"errors"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+type SyncPolicy int
+
+const (
+	// Sync after every write, callbacks fire after the sync.
+	SyncEveryWrite SyncPolicy = iota
+	// Write all queued payloads then sync once, callbacks fire after the sync.
+	SyncGroupCommit
+	// Sync periodically, callbacks fire after the write.
+	SyncInterval
+	// Leave it to the OS, callbacks fire after the write.
+	SyncNever
+)
+
+type rotatePayload struct {
+	callback func(error)
+}
+
+type FileHandle struct {
+	Handle
+	rotateTx chan *rotatePayload
+}
+
+// Rotate the file immediately.
+func (h *FileHandle) Rotate() {
+	h.RotateThen(func(error) {})
+}
+
+func (h *FileHandle) RotateThen(callback func(error)) {
+	rotateTx := h.rotateTx
+	go func() {
+		rotateTx <- &rotatePayload{callback: callback}
+	}()
+}
+
 type FileNode struct {
-	handle   *Handle
-	filename string
-	stopRx   chan *StopPayload
-	rx       chan *WritePayload
+	handle       *FileHandle
+	filename     string
+	maxSize      int64
+	interval     RotateInterval
+	pattern      string
+	timeLayout   string
+	maxBackups   int
+	maxAgeMs     uint64
+	compress     bool
+	errorHandler func(error)
+	syncPolicy   SyncPolicy
+	syncMs       uint64
+	flag         int
+	fileMode     os.FileMode
+	createDirs   bool
+	separator    []byte
+	snapshot     bool
+	stopRx       chan *StopPayload
+	rx           chan *WritePayload
+	rotateRx     chan *rotatePayload
 }
 
 func NewFileNode(buffer uint) *FileNode {
 	stopChan := make(chan *StopPayload)
 	msgChan := make(chan *WritePayload, buffer)
+	rotateChan := make(chan *rotatePayload)
 
 	handle, _ := NewHandleBuilder().StopTx(stopChan).Tx(msgChan).Build()
 	return &FileNode{
-		handle:   handle,
-		filename: "",
-		stopRx:   stopChan,
-		rx:       msgChan,
+		handle:       &FileHandle{Handle: *handle, rotateTx: rotateChan},
+		filename:     "",
+		maxSize:      0,
+		interval:     RotateNever,
+		pattern:      DefaultRotatedName,
+		timeLayout:   DefaultRotatedTimeLayout,
+		maxBackups:   0,
+		maxAgeMs:     0,
+		compress:     false,
+		errorHandler: func(error) {},
+		syncPolicy:   SyncEveryWrite,
+		syncMs:       1000,
+		flag:         os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+		fileMode:     0666,
+		createDirs:   false,
+		separator:    []byte{'\n'},
+		snapshot:     false,
+		stopRx:       stopChan,
+		rx:           msgChan,
+		rotateRx:     rotateChan,
 	}
 }
 
@@ -34,39 +104,316 @@ func (n *FileNode) Filename(name string) *FileNode {
 	return n
 }
 
-func (n *FileNode) Handle() *Handle {
+// Flags used to open the file, e.g. `os.O_WRONLY | os.O_CREATE | os.O_TRUNC` to overwrite the file.
+// Default is `os.O_WRONLY | os.O_CREATE | os.O_APPEND`.
+func (n *FileNode) OpenFlags(flag int) *FileNode {
+	n.flag = flag
+	return n
+}
+
+// Permission of a new file, before umask. Default is 0666.
+func (n *FileNode) FileMode(mode os.FileMode) *FileNode {
+	n.fileMode = mode
+	return n
+}
+
+// Create missing parent directories with permission 0755. Default is false.
+func (n *FileNode) CreateDirs(enable bool) *FileNode {
+	n.createDirs = enable
+	return n
+}
+
+// Appended to every payload, nil means write payloads as is. Default is `\n`.
+func (n *FileNode) Separator(sep []byte) *FileNode {
+	n.separator = sep
+	return n
+}
+
+// Replace the whole file with every payload atomically, by writing a temp file then renaming it.
+// Separator and rotation are not used in this mode. Default is false.
+func (n *FileNode) Snapshot(enable bool) *FileNode {
+	n.snapshot = enable
+	return n
+}
+
+// Rotate the file before it exceeds the size in bytes. Default is 0 which means no limit.
+func (n *FileNode) MaxSize(bytes int64) *FileNode {
+	n.maxSize = bytes
+	return n
+}
+
+// Rotate the file at the start of every hour or day in local time. Default is `RotateNever`.
+func (n *FileNode) RotateInterval(interval RotateInterval) *FileNode {
+	n.interval = interval
+	return n
+}
+
+// Set the name of rotated files. Default is `DefaultRotatedName`.
+// Placeholders: `{name}` is the filename without extension, `{ext}` is the extension,
+// `{time}` is the time when the file was opened, `{index}` avoids name conflicts.
+// If there is no `{index}` and the name is taken, `.<index>` will be appended.
+func (n *FileNode) RotatedName(pattern string) *FileNode {
+	n.pattern = pattern
+	return n
+}
+
+// Set the layout of `{time}` in rotated names. Default is `DefaultRotatedTimeLayout`.
+func (n *FileNode) RotatedTimeLayout(layout string) *FileNode {
+	n.timeLayout = layout
+	return n
+}
+
+// Keep at most `count` rotated files. Default is 0 which means no limit.
+func (n *FileNode) MaxBackups(count int) *FileNode {
+	n.maxBackups = count
+	return n
+}
+
+// Remove rotated files older than `ms`. Default is 0 which means no limit.
+func (n *FileNode) MaxBackupAgeMs(ms uint64) *FileNode {
+	n.maxAgeMs = ms
+	return n
+}
+
+// Compress rotated files with gzip. Default is false.
+func (n *FileNode) Compress(enable bool) *FileNode {
+	n.compress = enable
+	return n
+}
+
+// Choose the durability and throughput tradeoff. Default is `SyncEveryWrite`.
+// The file is always synced before it's rotated or closed, unless the policy is `SyncNever`.
+func (n *FileNode) SyncPolicy(p SyncPolicy) *FileNode {
+	n.syncPolicy = p
+	return n
+}
+
+// The interval of `SyncInterval`. Default is 1000.
+func (n *FileNode) SyncIntervalMs(ms uint64) *FileNode {
+	n.syncMs = ms
+	return n
+}
+
+// Collect queued payloads into a batch, starting with `first`.
+func (n *FileNode) drain(first *WritePayload) []*WritePayload {
+	batch := []*WritePayload{first}
+	for {
+		select {
+		case payload := <-n.rx:
+			batch = append(batch, payload)
+		default:
+			return batch
+		}
+	}
+}
+
+// The handler will get errors of scheduled rotation, periodic sync, compression and pruning.
+func (n *FileNode) OnError(f func(error)) *FileNode {
+	n.errorHandler = f
+	return n
+}
+
+func (n *FileNode) Handle() *FileHandle {
 	return n.handle
 }
 
-func (n FileNode) Go() (*Handle, error) {
+func (n *FileNode) open(flag int) (*os.File, int64, error) {
+	file, err := os.OpenFile(n.filename, flag, n.fileMode)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// Return error if missing `filename`.
+func (n *FileNode) Go() (*FileHandle, error) {
 	if len(n.filename) == 0 {
 		return nil, errors.New("missing filename")
 	}
+	if n.createDirs {
+		if err := os.MkdirAll(filepath.Dir(n.filename), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if n.snapshot {
+		go n.snapshotLoop()
+		return n.handle, nil
+	}
 
-	file, err := os.OpenFile(n.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	file, size, err := n.open(n.flag)
 	if err != nil {
 		return nil, err
 	}
 
-	rx := n.rx
-	stopRx := n.stopRx
-
 	go func() {
+		opened := time.Now()
+		maintenance := &sync.WaitGroup{}
+		lock := &sync.Mutex{} // one maintenance at a time
+
+		var timer *time.Timer = nil
+		var timerC <-chan time.Time = nil
+		resetTimer := func() {
+			if next := n.interval.next(opened); !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				timerC = timer.C
+			}
+		}
+		resetTimer()
+
+		dirty := false // written but not synced
+		broken := false
+
+		syncFile := func() error {
+			if !dirty {
+				return nil
+			}
+			dirty = false
+			return file.Sync()
+		}
+
+		rotate := func() error {
+			if file == nil {
+				return errors.New("file is closed")
+			}
+			if n.syncPolicy != SyncNever {
+				if err := syncFile(); err != nil {
+					return err
+				}
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			rotated, renameErr := n.rotatedFilename(opened)
+			if renameErr == nil {
+				renameErr = os.Rename(n.filename, rotated)
+			}
+			// reopen the file even if renaming failed, but don't truncate it then
+			flag := n.flag
+			if renameErr != nil {
+				flag &^= os.O_TRUNC
+			}
+			var openErr error
+			file, size, openErr = n.open(flag)
+			if openErr != nil {
+				file = nil
+				broken = true
+				return openErr
+			}
+			if renameErr != nil {
+				return renameErr
+			}
+
+			opened = time.Now()
+			maintenance.Add(1)
+			go func() {
+				defer maintenance.Done()
+				lock.Lock()
+				defer lock.Unlock()
+				n.maintain(rotated)
+			}()
+			return nil
+		}
+
+		write := func(data []byte) error {
+			line := data
+			if len(n.separator) != 0 {
+				line = append(data, n.separator...)
+			}
+			if n.maxSize != 0 && size != 0 && size+int64(len(line)) > n.maxSize {
+				if err := rotate(); err != nil {
+					return err
+				}
+			}
+			if file == nil {
+				return errors.New("file is closed")
+			}
+			if _, err := file.Write(line); err != nil {
+				broken = true
+				return err
+			}
+			size += int64(len(line))
+			dirty = true
+			return nil
+		}
+
+		var syncC <-chan time.Time = nil
+		if n.syncPolicy == SyncInterval && n.syncMs != 0 {
+			syncTicker := time.NewTicker(time.Duration(n.syncMs) * time.Millisecond)
+			defer syncTicker.Stop()
+			syncC = syncTicker.C
+		}
+
 		loop := true
 		for loop {
 			select {
-			case payload := <-rx:
-				if _, err := file.Write(append(payload.Data, '\n')); err != nil {
-					payload.Callback(err)
+			case payload := <-n.rx:
+				batch := []*WritePayload{payload}
+				if n.syncPolicy == SyncGroupCommit {
+					batch = n.drain(payload)
+				}
+
+				written := make([]*WritePayload, 0, len(batch))
+				for _, p := range batch {
+					if err := write(p.Data); err != nil {
+						p.Callback(err)
+					} else {
+						written = append(written, p)
+					}
+				}
+
+				var err error = nil
+				if n.syncPolicy == SyncEveryWrite || n.syncPolicy == SyncGroupCommit {
+					if err = syncFile(); err != nil {
+						broken = true
+					}
+				}
+				for _, p := range written {
+					p.Callback(err)
+				}
+				if broken {
 					loop = false
-				} else if err = file.Sync(); err != nil {
-					payload.Callback(err)
+				}
+			case <-syncC:
+				if err := syncFile(); err != nil {
+					n.errorHandler(err)
+				}
+			case <-timerC:
+				// empty files are kept
+				if size == 0 {
+					opened = time.Now()
+				} else if err := rotate(); err != nil {
+					// wait for the next interval instead of retrying immediately
+					opened = time.Now()
+					n.errorHandler(err)
+				}
+				if broken {
 					loop = false
 				} else {
-					payload.Callback(nil)
+					resetTimer()
 				}
-			case payload := <-stopRx:
-				payload.Callback(nil)
+			case payload := <-n.rotateRx:
+				payload.callback(rotate())
+				if broken {
+					loop = false
+				}
+			case payload := <-n.stopRx:
+				if timer != nil {
+					timer.Stop()
+				}
+				var err error = nil
+				if n.syncPolicy != SyncNever {
+					err = syncFile()
+				}
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+				maintenance.Wait()
+				payload.Callback(err)
 				loop = false
 			}
 		}
@@ -74,3 +421,60 @@ func (n FileNode) Go() (*Handle, error) {
 
 	return n.handle, nil
 }
+
+// Write the file via a temp file in the same directory, so readers never see a partial file.
+func writeFileAtomic(filename string, data []byte, mode os.FileMode, sync bool) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if sync {
+		return syncDir(filepath.Dir(filename))
+	}
+	return nil
+}
+
+// Make the rename durable. Not all platforms support syncing a directory, so errors are ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	d.Sync()
+	return d.Close()
+}
+
+func (n *FileNode) snapshotLoop() {
+	loop := true
+	for loop {
+		select {
+		case payload := <-n.rx:
+			// only the latest payload matters
+			batch := n.drain(payload)
+			err := writeFileAtomic(n.filename, batch[len(batch)-1].Data, n.fileMode, n.syncPolicy != SyncNever)
+			for _, p := range batch {
+				p.Callback(err)
+			}
+		case payload := <-n.rotateRx:
+			payload.callback(errors.New("rotation is not supported in snapshot mode"))
+		case payload := <-n.stopRx:
+			payload.Callback(nil)
+			loop = false
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package rua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFileNode(t *testing.T, h *FileHandle, data string) {
+	done := make(chan bool)
+	h.WriteThen([]byte(data), func(err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	})
+	<-done
+}
+
+func stopFileNode(t *testing.T, h *FileHandle) {
+	done := make(chan bool)
+	h.StopThen(func(err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	})
+	<-done
+}
+
+func TestFileNodeOpenFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		node func(*FileNode) *FileNode
+		want string
+	}{
+		{"append", func(n *FileNode) *FileNode { return n }, "old\na\nb\n"},
+		{"truncate", func(n *FileNode) *FileNode { return n.OpenFlags(os.O_WRONLY | os.O_CREATE | os.O_TRUNC) }, "a\nb\n"},
+		{"no separator", func(n *FileNode) *FileNode { return n.Separator(nil) }, "old\nab"},
+		{"custom separator", func(n *FileNode) *FileNode { return n.Separator([]byte("\r\n")) }, "old\na\r\nb\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.log")
+			ioutil.WriteFile(path, []byte("old\n"), 0644)
+			h, err := tt.node(DefaultFileNode().Filename(path)).Go()
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFileNode(t, h, "a")
+			writeFileNode(t, h, "b")
+			stopFileNode(t, h)
+
+			if got, _ := ioutil.ReadFile(path); string(got) != tt.want {
+				t.Fatalf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFileNodeCreateDirs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a", "b", "f.log")
+	if _, err := DefaultFileNode().Filename(path).Go(); err == nil {
+		t.Fatal("want error when the directory doesn't exist")
+	}
+
+	h, err := DefaultFileNode().Filename(path).CreateDirs(true).FileMode(0600).Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFileNode(t, h, "a")
+	stopFileNode(t, h)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("want mode 0600, got %v", info.Mode().Perm())
+	}
+	if info, _ := os.Stat(filepath.Dir(path)); !info.IsDir() {
+		t.Fatal("want the parent directory created")
+	}
+}
+
+func TestFileNodeSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	h, err := DefaultFileNode().Filename(path).Snapshot(true).Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// large payloads, so a partial write would be visible to readers
+	payloads := []string{}
+	for _, c := range "abcdefghijklmnop" {
+		payloads = append(payloads, string(bytes.Repeat([]byte{byte(c)}, 1024*1024)))
+	}
+	done := make(chan bool)
+	go func() {
+		for _, p := range payloads {
+			writeFileNode(t, h, p)
+		}
+		close(done)
+	}()
+
+	reading := true
+	for reading {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		got, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1024*1024 || bytes.Count(got, got[:1]) != len(got) {
+			t.Fatalf("want a whole payload, got %d bytes", len(got))
+		}
+	}
+
+	rotated := make(chan error)
+	h.RotateThen(func(err error) { rotated <- err })
+	if err := <-rotated; err == nil {
+		t.Fatal("want error when rotating a snapshot")
+	}
+	stopFileNode(t, h)
+
+	if got, _ := ioutil.ReadFile(path); string(got) != payloads[len(payloads)-1] {
+		t.Fatal("want the last payload without a separator")
+	}
+	// no temp file is left
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("want only the snapshot in the directory, got %d files", len(files))
+	}
+}
@@ -0,0 +1,32 @@
+package rua
+
+// Application-level heartbeat for stream nodes.
+// A ping frame is sent every interval, the peer should reply a pong frame.
+// The node will be stopped if `maxMissed` pings in a row are not answered, 0 is treated as 1.
+// Received ping frames are answered automatically.
+// Ping and pong frames are not passed to the input handler.
+type Heartbeat struct {
+	IntervalMs uint64
+	MaxMissed  uint32
+	Ping       []byte
+	Pong       []byte
+}
+
+func NewHeartbeat(intervalMs uint64, maxMissed uint32) *Heartbeat {
+	return &Heartbeat{
+		IntervalMs: intervalMs,
+		MaxMissed:  maxMissed,
+		Ping:       []byte("ping"),
+		Pong:       []byte("pong"),
+	}
+}
+
+func DefaultHeartbeat() *Heartbeat {
+	return NewHeartbeat(5000, 3)
+}
+
+func (h *Heartbeat) Messages(ping, pong []byte) *Heartbeat {
+	h.Ping = ping
+	h.Pong = pong
+	return h
+}
@@ -0,0 +1,384 @@
+package rua
+
+import (
+	"errors"
+	"time"
+)
+
+type limiterKey struct {
+	key string
+	gen uint64
+}
+
+// Start a timer which will send the key to `expired` when it fires, unless `stopped` is closed.
+func startLimiterTimer(ms uint64, k limiterKey, expired chan limiterKey, stopped chan bool) *time.Timer {
+	return time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		select {
+		case expired <- k:
+		case <-stopped:
+		}
+	})
+}
+
+// Emitted messages will get the result of writing to the target in the callback,
+// messages which are dropped or replaced by a newer message will get a nil error.
+func emitTo(target *Handle, payload *WritePayload) {
+	target.WriteThen(payload.Data, payload.Callback)
+}
+
+type debounceState struct {
+	pending *WritePayload
+	timer   *time.Timer
+	gen     uint64
+}
+
+// Emit a message after no message with the same key is received during the window.
+type DebounceNode struct {
+	target   *Handle
+	windowMs uint64
+	leading  bool
+	trailing bool
+	keyFunc  func([]byte) string
+	handle   *Handle
+	rx       chan *WritePayload
+	stopRx   chan *StopPayload
+}
+
+func NewDebounceNode(target *Handle, windowMs uint64, buffer uint) *DebounceNode {
+	msgChan := make(chan *WritePayload, buffer)
+	stopChan := make(chan *StopPayload)
+
+	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
+	return &DebounceNode{
+		target:   target,
+		windowMs: windowMs,
+		leading:  false,
+		trailing: true,
+		keyFunc:  nil,
+		handle:   handle,
+		rx:       msgChan,
+		stopRx:   stopChan,
+	}
+}
+
+func DefaultDebounceNode(target *Handle, windowMs uint64) *DebounceNode {
+	return NewDebounceNode(target, windowMs, 16)
+}
+
+// Debounce `target` with default options.
+func Debounce(target *Handle, windowMs uint64) (*Handle, error) {
+	return DefaultDebounceNode(target, windowMs).Go()
+}
+
+// Emit the first message of a burst immediately. Default is false.
+func (n *DebounceNode) Leading(enable bool) *DebounceNode {
+	n.leading = enable
+	return n
+}
+
+// Emit the last message of a burst after the window. Default is true.
+func (n *DebounceNode) Trailing(enable bool) *DebounceNode {
+	n.trailing = enable
+	return n
+}
+
+// Debounce messages with different keys separately.
+func (n *DebounceNode) KeyBy(f func([]byte) string) *DebounceNode {
+	n.keyFunc = f
+	return n
+}
+
+func (n *DebounceNode) Handle() *Handle {
+	return n.handle
+}
+
+// Return error if missing `target`, or both `leading` and `trailing` are false.
+func (n *DebounceNode) Go() (*Handle, error) {
+	if n.target == nil {
+		return nil, errors.New("missing target")
+	}
+	if !n.leading && !n.trailing {
+		return nil, errors.New("leading and trailing are both disabled")
+	}
+
+	go func() {
+		states := make(map[string]*debounceState)
+		expired := make(chan limiterKey)
+		stopped := make(chan bool)
+		defer close(stopped)
+
+		loop := true
+		for loop {
+			select {
+			case payload := <-n.rx:
+				key := ""
+				if n.keyFunc != nil {
+					key = n.keyFunc(payload.Data)
+				}
+				st, ok := states[key]
+				if !ok {
+					st = &debounceState{}
+					states[key] = st
+					if n.leading {
+						emitTo(n.target, payload)
+					} else {
+						st.pending = payload
+					}
+				} else {
+					if st.pending != nil {
+						st.pending.Callback(nil)
+					}
+					st.pending = payload
+					st.timer.Stop()
+				}
+				st.gen += 1
+				st.timer = startLimiterTimer(n.windowMs, limiterKey{key, st.gen}, expired, stopped)
+			case k := <-expired:
+				st, ok := states[k.key]
+				if !ok || st.gen != k.gen {
+					break // outdated timer
+				}
+				delete(states, k.key)
+				if st.pending != nil {
+					if n.trailing {
+						emitTo(n.target, st.pending)
+					} else {
+						st.pending.Callback(nil)
+					}
+				}
+			case payload := <-n.stopRx:
+				for _, st := range states {
+					st.timer.Stop()
+					if st.pending != nil {
+						st.pending.Callback(nil)
+					}
+				}
+				payload.Callback(nil)
+				loop = false
+			}
+		}
+	}()
+
+	return n.handle, nil
+}
+
+// Emit at most one message with the same key during each interval.
+type ThrottleNode struct {
+	target     *Handle
+	intervalMs uint64
+	leading    bool
+	trailing   bool
+	keyFunc    func([]byte) string
+	handle     *Handle
+	rx         chan *WritePayload
+	stopRx     chan *StopPayload
+}
+
+func NewThrottleNode(target *Handle, intervalMs uint64, buffer uint) *ThrottleNode {
+	msgChan := make(chan *WritePayload, buffer)
+	stopChan := make(chan *StopPayload)
+
+	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
+	return &ThrottleNode{
+		target:     target,
+		intervalMs: intervalMs,
+		leading:    true,
+		trailing:   true,
+		keyFunc:    nil,
+		handle:     handle,
+		rx:         msgChan,
+		stopRx:     stopChan,
+	}
+}
+
+func DefaultThrottleNode(target *Handle, intervalMs uint64) *ThrottleNode {
+	return NewThrottleNode(target, intervalMs, 16)
+}
+
+// Throttle `target` with default options.
+func Throttle(target *Handle, intervalMs uint64) (*Handle, error) {
+	return DefaultThrottleNode(target, intervalMs).Go()
+}
+
+// Emit the first message of an interval immediately. Default is true.
+func (n *ThrottleNode) Leading(enable bool) *ThrottleNode {
+	n.leading = enable
+	return n
+}
+
+// Emit the last message of an interval when the interval ends. Default is true.
+func (n *ThrottleNode) Trailing(enable bool) *ThrottleNode {
+	n.trailing = enable
+	return n
+}
+
+// Throttle messages with different keys separately.
+func (n *ThrottleNode) KeyBy(f func([]byte) string) *ThrottleNode {
+	n.keyFunc = f
+	return n
+}
+
+func (n *ThrottleNode) Handle() *Handle {
+	return n.handle
+}
+
+// Return error if missing `target`, or both `leading` and `trailing` are false.
+func (n *ThrottleNode) Go() (*Handle, error) {
+	if n.target == nil {
+		return nil, errors.New("missing target")
+	}
+	if !n.leading && !n.trailing {
+		return nil, errors.New("leading and trailing are both disabled")
+	}
+
+	go func() {
+		// a key exists in `states` during its interval, the value is the pending message
+		states := make(map[string]*WritePayload)
+		timers := make(map[string]*time.Timer)
+		expired := make(chan limiterKey)
+		stopped := make(chan bool)
+		defer close(stopped)
+
+		loop := true
+		for loop {
+			select {
+			case payload := <-n.rx:
+				key := ""
+				if n.keyFunc != nil {
+					key = n.keyFunc(payload.Data)
+				}
+				if pending, ok := states[key]; ok {
+					if pending != nil {
+						pending.Callback(nil)
+					}
+					states[key] = payload
+				} else {
+					if n.leading {
+						emitTo(n.target, payload)
+						states[key] = nil
+					} else {
+						states[key] = payload
+					}
+					timers[key] = startLimiterTimer(n.intervalMs, limiterKey{key: key}, expired, stopped)
+				}
+			case k := <-expired:
+				pending := states[k.key]
+				if pending != nil && n.trailing {
+					// start a new interval
+					emitTo(n.target, pending)
+					states[k.key] = nil
+					timers[k.key] = startLimiterTimer(n.intervalMs, k, expired, stopped)
+				} else {
+					if pending != nil {
+						pending.Callback(nil)
+					}
+					delete(states, k.key)
+					delete(timers, k.key)
+				}
+			case payload := <-n.stopRx:
+				for key, pending := range states {
+					timers[key].Stop()
+					if pending != nil {
+						pending.Callback(nil)
+					}
+				}
+				payload.Callback(nil)
+				loop = false
+			}
+		}
+	}()
+
+	return n.handle, nil
+}
+
+// Emit the latest message of each key periodically.
+type SampleNode struct {
+	target     *Handle
+	intervalMs uint64
+	keyFunc    func([]byte) string
+	handle     *Handle
+	rx         chan *WritePayload
+	stopRx     chan *StopPayload
+}
+
+func NewSampleNode(target *Handle, intervalMs uint64, buffer uint) *SampleNode {
+	msgChan := make(chan *WritePayload, buffer)
+	stopChan := make(chan *StopPayload)
+
+	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
+	return &SampleNode{
+		target:     target,
+		intervalMs: intervalMs,
+		keyFunc:    nil,
+		handle:     handle,
+		rx:         msgChan,
+		stopRx:     stopChan,
+	}
+}
+
+func DefaultSampleNode(target *Handle, intervalMs uint64) *SampleNode {
+	return NewSampleNode(target, intervalMs, 16)
+}
+
+// Sample `target` with default options.
+func Sample(target *Handle, intervalMs uint64) (*Handle, error) {
+	return DefaultSampleNode(target, intervalMs).Go()
+}
+
+// Sample messages with different keys separately.
+func (n *SampleNode) KeyBy(f func([]byte) string) *SampleNode {
+	n.keyFunc = f
+	return n
+}
+
+func (n *SampleNode) Handle() *Handle {
+	return n.handle
+}
+
+// Return error if missing `target` or `intervalMs` is 0.
+func (n *SampleNode) Go() (*Handle, error) {
+	if n.target == nil {
+		return nil, errors.New("missing target")
+	}
+	if n.intervalMs == 0 {
+		return nil, errors.New("invalid intervalMs")
+	}
+
+	go func() {
+		latest := make(map[string]*WritePayload)
+		keys := []string{} // keys in arrival order
+		ticker := time.NewTicker(time.Duration(n.intervalMs) * time.Millisecond)
+		defer ticker.Stop()
+
+		loop := true
+		for loop {
+			select {
+			case payload := <-n.rx:
+				key := ""
+				if n.keyFunc != nil {
+					key = n.keyFunc(payload.Data)
+				}
+				if old, ok := latest[key]; ok {
+					old.Callback(nil)
+				} else {
+					keys = append(keys, key)
+				}
+				latest[key] = payload
+			case <-ticker.C:
+				for _, key := range keys {
+					emitTo(n.target, latest[key])
+				}
+				latest = make(map[string]*WritePayload)
+				keys = []string{}
+			case payload := <-n.stopRx:
+				for _, p := range latest {
+					p.Callback(nil)
+				}
+				payload.Callback(nil)
+				loop = false
+			}
+		}
+	}()
+
+	return n.handle, nil
+}
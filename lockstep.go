@@ -0,0 +1,166 @@
+package rua
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+type LockstepInput struct {
+	PeerId uint      `json:"peer"`
+	Data   []byte    `json:"data"`
+	Time   time.Time `json:"time"` // arrival time
+}
+
+type LockstepFrame struct {
+	Tick   uint64           `json:"tick"`
+	Inputs []*LockstepInput `json:"inputs"`
+}
+
+type stepMsPayload struct {
+	stepMs   uint64
+	callback func(error)
+}
+
+type LockstepHandle struct {
+	StopOnlyHandle
+	inputTx  chan *LockstepInput
+	stepMsTx chan *stepMsPayload
+}
+
+// Record an input of the peer, it will be emitted in the next frame.
+func (h *LockstepHandle) Input(peerId uint, data []byte) {
+	inputTx := h.inputTx
+	input := &LockstepInput{PeerId: peerId, Data: data, Time: time.Now()}
+	go func() {
+		inputTx <- input
+	}()
+}
+
+// Change the step length, it will take effect from the next step.
+func (h *LockstepHandle) SetStepMs(ms uint64) {
+	h.SetStepMsThen(ms, func(error) {})
+}
+
+func (h *LockstepHandle) SetStepMsThen(ms uint64, callback func(error)) {
+	stepMsTx := h.stepMsTx
+	go func() {
+		stepMsTx <- &stepMsPayload{stepMs: ms, callback: callback}
+	}()
+}
+
+type LockstepNode struct {
+	stepMs      uint64
+	stepHandler func(*LockstepFrame)
+	broadcaster *Broadcaster
+	encoder     func(*LockstepFrame) []byte
+	handle      *LockstepHandle
+	stopRx      chan *StopPayload
+	inputRx     chan *LockstepInput
+	stepMsRx    chan *stepMsPayload
+}
+
+func NewLockstepNode(stepMs uint64) *LockstepNode {
+	stopChan := make(chan *StopPayload)
+	inputChan := make(chan *LockstepInput)
+	stepMsChan := make(chan *stepMsPayload)
+
+	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
+	return &LockstepNode{
+		stepMs:      stepMs,
+		stepHandler: nil,
+		broadcaster: nil,
+		encoder:     DefaultLockstepFrameEncoder,
+		handle:      &LockstepHandle{StopOnlyHandle: *handle, inputTx: inputChan, stepMsTx: stepMsChan},
+		stopRx:      stopChan,
+		inputRx:     inputChan,
+		stepMsRx:    stepMsChan,
+	}
+}
+
+func DefaultLockstepNode() *LockstepNode {
+	return NewLockstepNode(100)
+}
+
+// Encode the frame as JSON.
+func DefaultLockstepFrameEncoder(frame *LockstepFrame) []byte {
+	b, _ := json.Marshal(frame)
+	return b
+}
+
+func (n *LockstepNode) StepMs(ms uint64) *LockstepNode {
+	n.stepMs = ms
+	return n
+}
+
+func (n *LockstepNode) OnStep(f func(*LockstepFrame)) *LockstepNode {
+	n.stepHandler = f
+	return n
+}
+
+// Write every encoded frame to the broadcaster.
+func (n *LockstepNode) Broadcaster(bc *Broadcaster) *LockstepNode {
+	n.broadcaster = bc
+	return n
+}
+
+// Set the encoder used before writing frames to the broadcaster.
+func (n *LockstepNode) FrameEncoder(f func(*LockstepFrame) []byte) *LockstepNode {
+	n.encoder = f
+	return n
+}
+
+func (n *LockstepNode) Handle() *LockstepHandle {
+	return n.handle
+}
+
+// Return error if missing both `stepHandler` and `broadcaster`, or `stepMs` is 0.
+func (n *LockstepNode) Go() (*LockstepHandle, error) {
+	if n.stepHandler == nil && n.broadcaster == nil {
+		return nil, errors.New("missing stepHandler")
+	}
+	if n.stepMs == 0 {
+		return nil, errors.New("invalid stepMs")
+	}
+
+	go func() {
+		var current uint64 = 0
+		inputs := []*LockstepInput{}
+		ticker := time.NewTicker(time.Duration(n.stepMs) * time.Millisecond)
+		defer ticker.Stop()
+
+		loop := true
+		for loop {
+			select {
+			case input := <-n.inputRx:
+				inputs = append(inputs, input)
+			case <-ticker.C:
+				sort.SliceStable(inputs, func(i, j int) bool {
+					return inputs[i].Time.Before(inputs[j].Time)
+				})
+				frame := &LockstepFrame{Tick: current, Inputs: inputs}
+				if n.stepHandler != nil {
+					n.stepHandler(frame)
+				}
+				if n.broadcaster != nil {
+					n.broadcaster.Write(n.encoder(frame))
+				}
+				inputs = []*LockstepInput{}
+				current += 1
+			case payload := <-n.stepMsRx:
+				if payload.stepMs == 0 {
+					payload.callback(errors.New("invalid stepMs"))
+				} else {
+					ticker.Reset(time.Duration(payload.stepMs) * time.Millisecond)
+					payload.callback(nil)
+				}
+			case payload := <-n.stopRx:
+				payload.Callback(nil)
+				loop = false
+			}
+		}
+	}()
+
+	return n.handle, nil
+}
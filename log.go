@@ -0,0 +1,536 @@
+package rua
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLogCorrupt     = errors.New("corrupt log record")
+	ErrRecordTooLarge = errors.New("log record too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	logHeaderSize     = 8 // length and crc
+	logSegmentSuffix  = ".log"
+	logSegmentNameLen = 20
+)
+
+type logAppendPayload struct {
+	data     []byte
+	callback func(uint64, error)
+}
+
+type logReplayPayload struct {
+	from     uint64
+	handler  func(uint64, []byte)
+	callback func(uint64, error)
+}
+
+type LogHandle struct {
+	Handle
+	appendTx chan *logAppendPayload
+	replayTx chan *logReplayPayload
+}
+
+// Append a record, the callback will get its offset.
+func (h *LogHandle) Append(data []byte) {
+	h.AppendThen(data, func(uint64, error) {})
+}
+
+func (h *LogHandle) AppendThen(data []byte, callback func(offset uint64, err error)) {
+	appendTx := h.appendTx
+	go func() {
+		appendTx <- &logAppendPayload{data: data, callback: callback}
+	}()
+}
+
+// Call the handler with every record from the offset, in a new goroutine.
+// If the offset was removed by retention, start from the first available record.
+func (h *LogHandle) Replay(from uint64, handler func(offset uint64, data []byte)) {
+	h.ReplayThen(from, handler, func(uint64, error) {})
+}
+
+// The callback will get the offset after the last replayed record.
+// Records appended after the replay started are not included.
+func (h *LogHandle) ReplayThen(from uint64, handler func(offset uint64, data []byte), callback func(next uint64, err error)) {
+	replayTx := h.replayTx
+	go func() {
+		replayTx <- &logReplayPayload{from: from, handler: handler, callback: callback}
+	}()
+}
+
+type logSegment struct {
+	base uint64
+	path string
+}
+
+// LogNode appends length-prefixed and CRC-checked records into segment files.
+type LogNode struct {
+	handle        *LogHandle
+	dir           string
+	segmentSize   int64
+	maxRecordSize int
+	maxSegments   int
+	retentionMs   uint64
+	syncPolicy    SyncPolicy
+	syncMs        uint64
+	errorHandler  func(error)
+	stopRx        chan *StopPayload
+	rx            chan *WritePayload
+	appendRx      chan *logAppendPayload
+	replayRx      chan *logReplayPayload
+}
+
+// Segments are stored in `dir`.
+func NewLogNode(dir string, buffer uint) *LogNode {
+	stopChan := make(chan *StopPayload)
+	msgChan := make(chan *WritePayload, buffer)
+	appendChan := make(chan *logAppendPayload, buffer)
+	replayChan := make(chan *logReplayPayload)
+
+	handle, _ := NewHandleBuilder().StopTx(stopChan).Tx(msgChan).Build()
+	return &LogNode{
+		handle:        &LogHandle{Handle: *handle, appendTx: appendChan, replayTx: replayChan},
+		dir:           dir,
+		segmentSize:   64 << 20,
+		maxRecordSize: 16 << 20,
+		maxSegments:   0,
+		retentionMs:   0,
+		syncPolicy:    SyncEveryWrite,
+		syncMs:        1000,
+		errorHandler:  func(error) {},
+		stopRx:        stopChan,
+		rx:            msgChan,
+		appendRx:      appendChan,
+		replayRx:      replayChan,
+	}
+}
+
+func DefaultLogNode(dir string) *LogNode {
+	return NewLogNode(dir, 16)
+}
+
+// Start a new segment before the current one exceeds the size in bytes. Default is 64MB.
+func (n *LogNode) SegmentSize(bytes int64) *LogNode {
+	n.segmentSize = bytes
+	return n
+}
+
+// Larger records will be rejected, and treated as corruption when read. Default is 16MB.
+func (n *LogNode) MaxRecordSize(size int) *LogNode {
+	n.maxRecordSize = size
+	return n
+}
+
+// Keep at most `count` segments including the current one. Default is 0 which means no limit.
+func (n *LogNode) MaxSegments(count int) *LogNode {
+	n.maxSegments = count
+	return n
+}
+
+// Remove segments which are not modified for `ms`. The current segment is always kept.
+// Default is 0 which means no limit.
+func (n *LogNode) RetentionMs(ms uint64) *LogNode {
+	n.retentionMs = ms
+	return n
+}
+
+// Default is `SyncEveryWrite`.
+func (n *LogNode) SyncPolicy(p SyncPolicy) *LogNode {
+	n.syncPolicy = p
+	return n
+}
+
+// The interval of `SyncInterval`. Default is 1000.
+func (n *LogNode) SyncIntervalMs(ms uint64) *LogNode {
+	n.syncMs = ms
+	return n
+}
+
+// The handler will get errors of recovery, periodic sync and retention.
+func (n *LogNode) OnError(f func(error)) *LogNode {
+	n.errorHandler = f
+	return n
+}
+
+func (n *LogNode) Handle() *LogHandle {
+	return n.handle
+}
+
+func (n *LogNode) segmentPath(base uint64) string {
+	return filepath.Join(n.dir, fmt.Sprintf("%020d%s", base, logSegmentSuffix))
+}
+
+// Return segments sorted by base offset.
+func (n *LogNode) listSegments() ([]*logSegment, error) {
+	infos, err := ioutil.ReadDir(n.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []*logSegment{}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasSuffix(name, logSegmentSuffix) || len(name) != logSegmentNameLen+len(logSegmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, logSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &logSegment{base: base, path: filepath.Join(n.dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].base < segments[j].base
+	})
+	return segments, nil
+}
+
+// Read the next record. Return `ErrLogCorrupt` if the record is incomplete or invalid.
+func readLogRecord(r *bufio.Reader, maxSize int) ([]byte, error) {
+	header := make([]byte, logHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, io.EOF
+		}
+		return nil, ErrLogCorrupt
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if maxSize != 0 && int64(length) > int64(maxSize) {
+		return nil, ErrLogCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrLogCorrupt
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrLogCorrupt
+	}
+	return data, nil
+}
+
+func encodeLogRecord(data []byte) []byte {
+	buf := make([]byte, logHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[logHeaderSize:], data)
+	return buf
+}
+
+// Return the number of valid records and their total size.
+func (n *LogNode) scanSegment(path string) (uint64, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var count uint64 = 0
+	var size int64 = 0
+	for {
+		data, err := readLogRecord(reader, n.maxRecordSize)
+		if err == io.EOF || err == ErrLogCorrupt {
+			return count, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		count += 1
+		size += int64(logHeaderSize + len(data))
+	}
+}
+
+// Read records of the segment in [from, end), the segment is read until `limit` bytes if it's not -1.
+func (n *LogNode) readSegment(seg *logSegment, from, end uint64, limit int64, handler func(uint64, []byte)) (uint64, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return seg.base, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+	reader := bufio.NewReader(r)
+	offset := seg.base
+	for offset < end {
+		data, err := readLogRecord(reader, n.maxRecordSize)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		if offset >= from {
+			handler(offset, data)
+		}
+		offset += 1
+	}
+	return offset, nil
+}
+
+func (n *LogNode) replay(segments []*logSegment, activeSize int64, from, end uint64, handler func(uint64, []byte)) (uint64, error) {
+	if len(segments) == 0 || from >= end {
+		return end, nil
+	}
+	if from < segments[0].base {
+		from = segments[0].base
+	}
+	next := from
+	for i, seg := range segments {
+		// skip segments before the offset
+		if i+1 < len(segments) && segments[i+1].base <= from {
+			continue
+		}
+		var limit int64 = -1
+		if i == len(segments)-1 {
+			limit = activeSize
+		}
+		var err error
+		if next, err = n.readSegment(seg, from, end, limit, handler); err != nil {
+			return next, err
+		}
+	}
+	return next, nil
+}
+
+// Return error if missing `dir`, or the existing segments can't be opened.
+// A corrupt tail of the last segment will be truncated and reported to `OnError`.
+func (n *LogNode) Go() (*LogHandle, error) {
+	if len(n.dir) == 0 {
+		return nil, errors.New("missing dir")
+	}
+	if err := os.MkdirAll(n.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := n.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = append(segments, &logSegment{base: 0, path: n.segmentPath(0)})
+	}
+
+	// recover the last segment
+	active := segments[len(segments)-1]
+	var count uint64 = 0
+	var size int64 = 0
+	if _, err := os.Stat(active.path); err == nil {
+		if count, size, err = n.scanSegment(active.path); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(active.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	} else if info.Size() > size {
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, err
+		}
+		n.errorHandler(errors.New("truncated corrupt tail of " + active.path + " at " + strconv.FormatInt(size, 10)))
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	next := active.base + count
+
+	go func() {
+		dirty := false // written but not synced
+		broken := false
+
+		syncFile := func() error {
+			if !dirty {
+				return nil
+			}
+			dirty = false
+			return file.Sync()
+		}
+
+		prune := func() {
+			deadline := time.Now().Add(-time.Duration(n.retentionMs) * time.Millisecond)
+			for len(segments) > 1 {
+				expired := false
+				if n.maxSegments != 0 && len(segments) > n.maxSegments {
+					expired = true
+				} else if n.retentionMs != 0 {
+					if info, err := os.Stat(segments[0].path); err == nil && info.ModTime().Before(deadline) {
+						expired = true
+					}
+				}
+				if !expired {
+					return
+				}
+				if err := os.Remove(segments[0].path); err != nil && !os.IsNotExist(err) {
+					n.errorHandler(err)
+					return
+				}
+				segments = segments[1:]
+			}
+		}
+
+		// start a new segment
+		roll := func() error {
+			if n.syncPolicy != SyncNever {
+				if err := syncFile(); err != nil {
+					return err
+				}
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			seg := &logSegment{base: next, path: n.segmentPath(next)}
+			f, err := os.OpenFile(seg.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			file = f
+			size = 0
+			segments = append(segments, seg)
+			prune()
+			return nil
+		}
+
+		write := func(data []byte) (uint64, error) {
+			if n.maxRecordSize != 0 && len(data) > n.maxRecordSize {
+				return 0, ErrRecordTooLarge
+			}
+			record := encodeLogRecord(data)
+			if size != 0 && size+int64(len(record)) > n.segmentSize {
+				if err := roll(); err != nil {
+					broken = true
+					return 0, err
+				}
+			}
+			if _, err := file.Write(record); err != nil {
+				broken = true
+				return 0, err
+			}
+			size += int64(len(record))
+			dirty = true
+			offset := next
+			next += 1
+			return offset, nil
+		}
+
+		// handle a batch of appends, callbacks fire after the sync
+		commit := func(batch []*logAppendPayload) {
+			type result struct {
+				payload *logAppendPayload
+				offset  uint64
+			}
+			written := make([]*result, 0, len(batch))
+			for _, p := range batch {
+				if broken {
+					p.callback(0, errors.New("log is broken"))
+					continue
+				}
+				if offset, err := write(p.data); err != nil {
+					p.callback(0, err)
+				} else {
+					written = append(written, &result{payload: p, offset: offset})
+				}
+			}
+
+			var err error = nil
+			if n.syncPolicy == SyncEveryWrite || n.syncPolicy == SyncGroupCommit {
+				if err = syncFile(); err != nil {
+					broken = true
+				}
+			}
+			for _, r := range written {
+				r.payload.callback(r.offset, err)
+			}
+		}
+
+		fromWrite := func(p *WritePayload) *logAppendPayload {
+			return &logAppendPayload{data: p.Data, callback: func(_ uint64, err error) { p.Callback(err) }}
+		}
+
+		// collect queued appends for group commit
+		drain := func(batch []*logAppendPayload) []*logAppendPayload {
+			for {
+				select {
+				case p := <-n.appendRx:
+					batch = append(batch, p)
+				case p := <-n.rx:
+					batch = append(batch, fromWrite(p))
+				default:
+					return batch
+				}
+			}
+		}
+
+		var syncC <-chan time.Time = nil
+		if n.syncPolicy == SyncInterval && n.syncMs != 0 {
+			syncTicker := time.NewTicker(time.Duration(n.syncMs) * time.Millisecond)
+			defer syncTicker.Stop()
+			syncC = syncTicker.C
+		}
+
+		prune()
+
+		loop := true
+		for loop {
+			var batch []*logAppendPayload = nil
+			select {
+			case p := <-n.appendRx:
+				batch = []*logAppendPayload{p}
+			case p := <-n.rx:
+				batch = []*logAppendPayload{fromWrite(p)}
+			case <-syncC:
+				if err := syncFile(); err != nil {
+					n.errorHandler(err)
+				}
+			case p := <-n.replayRx:
+				snapshot := make([]*logSegment, len(segments))
+				copy(snapshot, segments)
+				activeSize := size
+				end := next
+				go func() {
+					p.callback(n.replay(snapshot, activeSize, p.from, end, p.handler))
+				}()
+			case payload := <-n.stopRx:
+				var err error = nil
+				if n.syncPolicy != SyncNever {
+					err = syncFile()
+				}
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+				payload.Callback(err)
+				loop = false
+			}
+
+			if batch != nil {
+				if n.syncPolicy == SyncGroupCommit {
+					batch = drain(batch)
+				}
+				commit(batch)
+			}
+		}
+	}()
+
+	return n.handle, nil
+}
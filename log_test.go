@@ -0,0 +1,148 @@
+package rua
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogRecordRoundTrip(t *testing.T) {
+	records := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("a"), 70000)}
+	stream := &bytes.Buffer{}
+	for _, data := range records {
+		stream.Write(encodeLogRecord(data))
+	}
+
+	r := bufio.NewReader(stream)
+	for _, want := range records {
+		got, err := readLogRecord(r, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("want %d bytes, got %d bytes", len(want), len(got))
+		}
+	}
+	if _, err := readLogRecord(r, 0); err != io.EOF {
+		t.Fatalf("want io.EOF, got %v", err)
+	}
+}
+
+func TestLogRecordCorrupt(t *testing.T) {
+	valid := encodeLogRecord([]byte("hello"))
+	flipped := append([]byte{}, valid...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		input   []byte
+		maxSize int
+	}{
+		{"partial header", valid[:3], 0},
+		{"partial body", valid[:len(valid)-1], 0},
+		{"bad crc", flipped, 0},
+		{"too large", valid, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readLogRecord(bufio.NewReader(bytes.NewReader(tt.input)), tt.maxSize); err != ErrLogCorrupt {
+				t.Fatalf("want ErrLogCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func appendLog(t *testing.T, h *LogHandle, data string) uint64 {
+	done := make(chan uint64)
+	h.AppendThen([]byte(data), func(offset uint64, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		done <- offset
+	})
+	return <-done
+}
+
+func replayLog(t *testing.T, h *LogHandle, from uint64) []string {
+	records := []string{}
+	done := make(chan bool)
+	h.ReplayThen(from, func(_ uint64, data []byte) {
+		records = append(records, string(data))
+	}, func(_ uint64, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	})
+	<-done
+	return records
+}
+
+func stopLog(t *testing.T, h *LogHandle) {
+	done := make(chan bool)
+	h.StopThen(func(err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		close(done)
+	})
+	<-done
+}
+
+func TestLogNodeTruncatesCorruptTail(t *testing.T) {
+	tails := map[string]func(record []byte) []byte{
+		"partial record": func(record []byte) []byte { return record[:len(record)-2] },
+		"bad crc": func(record []byte) []byte {
+			record[len(record)-1] ^= 1
+			return record
+		},
+		"garbage": func([]byte) []byte { return []byte{0xff, 0xff, 0xff} },
+	}
+
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			h, err := DefaultLogNode(dir).Go()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range []string{"a", "b", "c"} {
+				appendLog(t, h, data)
+			}
+			stopLog(t, h)
+
+			// simulate a crash in the middle of a write
+			path := filepath.Join(dir, "00000000000000000000.log")
+			before, _ := ioutil.ReadFile(path)
+			f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			f.Write(tail(encodeLogRecord([]byte("lost"))))
+			f.Close()
+
+			reported := []error{}
+			h, err = DefaultLogNode(dir).OnError(func(err error) { reported = append(reported, err) }).Go()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reported) != 1 || !strings.Contains(reported[0].Error(), "truncated") {
+				t.Fatalf("want one truncation error, got %v", reported)
+			}
+			if after, _ := ioutil.ReadFile(path); !bytes.Equal(after, before) {
+				t.Fatalf("want the tail truncated to %d bytes, got %d bytes", len(before), len(after))
+			}
+
+			if offset := appendLog(t, h, "d"); offset != 3 {
+				t.Fatalf("want offset 3, got %d", offset)
+			}
+			if got := strings.Join(replayLog(t, h, 0), ","); got != "a,b,c,d" {
+				t.Fatalf("want a,b,c,d, got %s", got)
+			}
+			stopLog(t, h)
+		})
+	}
+}
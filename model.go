@@ -21,6 +21,9 @@ func (p *WritePayload) WithCallback(f func(error)) *WritePayload {
 	return p
 }
 
+// Writes to a node which is already stopped fail with this error.
+var ErrNodeStopped = errors.New("node stopped")
+
 type StopPayload struct {
 	Callback func(error)
 }
@@ -0,0 +1,58 @@
+package rua
+
+import "sync"
+
+// Track nodes accepted by a listener until they are closed.
+type peerSet struct {
+	peers map[*StreamNode]bool
+	lock  *sync.Mutex
+}
+
+func newPeerSet() *peerSet {
+	return &peerSet{
+		peers: make(map[*StreamNode]bool),
+		lock:  &sync.Mutex{},
+	}
+}
+
+func (s *peerSet) add(node *StreamNode) {
+	s.lock.Lock()
+	s.peers[node] = true
+	s.lock.Unlock()
+	node.closeHandler = func() {
+		s.lock.Lock()
+		delete(s.peers, node)
+		s.lock.Unlock()
+	}
+}
+
+func (s *peerSet) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.peers)
+}
+
+// Stop all tracked peers, return the first error.
+func (s *peerSet) stopAll() error {
+	s.lock.Lock()
+	nodes := make([]*StreamNode, 0, len(s.peers))
+	for node := range s.peers {
+		nodes = append(nodes, node)
+	}
+	s.lock.Unlock()
+
+	results := make(chan error, len(nodes))
+	for _, node := range nodes {
+		node.stopThen(func(err error) {
+			results <- err
+		})
+	}
+
+	var firstErr error = nil
+	for range nodes {
+		if err := <-results; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
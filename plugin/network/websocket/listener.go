@@ -17,6 +17,10 @@ type wsListener struct {
 	keyFile         string
 	upgrader        *websocket.Upgrader
 	peerWriteBuffer uint
+	peerReadMs      uint64
+	peerWriteMs     uint64
+	peerPingMs      uint64
+	peerMaxMissed   uint32
 	handle          *rua.StopOnlyHandle
 	stopRx          chan *rua.StopPayload
 	peerHandler     func(*WsNode)
@@ -34,6 +38,10 @@ func NewWsListener(addr string) *wsListener {
 		keyFile:         "",
 		upgrader:        &websocket.Upgrader{},
 		peerWriteBuffer: 16,
+		peerReadMs:      0,
+		peerWriteMs:     0,
+		peerPingMs:      0,
+		peerMaxMissed:   0,
 		handle:          handle,
 		stopRx:          stopChan,
 		peerHandler:     nil,
@@ -50,6 +58,23 @@ func (l *wsListener) PeerWriteBuffer(buffer uint) *wsListener {
 	return l
 }
 
+func (l *wsListener) PeerReadTimeoutMs(ms uint64) *wsListener {
+	l.peerReadMs = ms
+	return l
+}
+
+func (l *wsListener) PeerWriteTimeoutMs(ms uint64) *wsListener {
+	l.peerWriteMs = ms
+	return l
+}
+
+// See `WsNode.Ping`.
+func (l *wsListener) PeerPing(intervalMs uint64, maxMissed uint32) *wsListener {
+	l.peerPingMs = intervalMs
+	l.peerMaxMissed = maxMissed
+	return l
+}
+
 func (l *wsListener) Path(p string) *wsListener {
 	l.path = p
 	return l
@@ -94,7 +119,12 @@ func (l *wsListener) Go() (*rua.StopOnlyHandle, error) {
 					panic(err)
 				}
 
-				l.peerHandler(NewWsNode(c, l.peerWriteBuffer))
+				l.peerHandler(
+					NewWsNode(c, l.peerWriteBuffer).
+						ReadTimeoutMs(l.peerReadMs).
+						WriteTimeoutMs(l.peerWriteMs).
+						Ping(l.peerPingMs, l.peerMaxMissed),
+				)
 			}
 		})
 		if len(l.certFile) != 0 && len(l.keyFile) != 0 {
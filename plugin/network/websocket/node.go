@@ -1,17 +1,25 @@
 package websocket
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/DiscreteTom/rua"
 
 	"github.com/gorilla/websocket"
 )
 
 type WsNode struct {
-	handle     *rua.Handle
-	c          *websocket.Conn
-	rx         chan *rua.WritePayload
-	stopRx     chan *rua.StopPayload
-	msgHandler func([]byte)
+	handle         *rua.Handle
+	c              *websocket.Conn
+	rx             chan *rua.WritePayload
+	stopRx         chan *rua.StopPayload
+	msgHandler     func([]byte)
+	readTimeoutMs  uint64
+	writeTimeoutMs uint64
+	pingIntervalMs uint64
+	maxMissedPongs uint32
 }
 
 func NewWsNode(c *websocket.Conn, buffer uint) *WsNode {
@@ -20,11 +28,15 @@ func NewWsNode(c *websocket.Conn, buffer uint) *WsNode {
 	handle, _ := rua.NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
 
 	return &WsNode{
-		c:          c,
-		handle:     handle,
-		rx:         msgChan,
-		stopRx:     stopChan,
-		msgHandler: func(b []byte) {},
+		c:              c,
+		handle:         handle,
+		rx:             msgChan,
+		stopRx:         stopChan,
+		msgHandler:     func(b []byte) {},
+		readTimeoutMs:  0,
+		writeTimeoutMs: 0,
+		pingIntervalMs: 0,
+		maxMissedPongs: 0,
 	}
 }
 
@@ -33,56 +45,128 @@ func (n *WsNode) OnMsg(f func([]byte)) *WsNode {
 	return n
 }
 
+// The node will be stopped if nothing is received during the timeout. Default is 0 which means no timeout.
+func (n *WsNode) ReadTimeoutMs(ms uint64) *WsNode {
+	n.readTimeoutMs = ms
+	return n
+}
+
+// The node will be stopped if a write can't finish during the timeout. Default is 0 which means no timeout.
+func (n *WsNode) WriteTimeoutMs(ms uint64) *WsNode {
+	n.writeTimeoutMs = ms
+	return n
+}
+
+// Send a websocket ping every interval, the node will be stopped if `maxMissed` pings in a row are not answered,
+// 0 is treated as 1.
+// Default interval is 0 which means no ping.
+func (n *WsNode) Ping(intervalMs uint64, maxMissed uint32) *WsNode {
+	n.pingIntervalMs = intervalMs
+	n.maxMissedPongs = maxMissed
+	return n
+}
+
 func (n *WsNode) Handle() *rua.Handle {
 	return n.handle
 }
 
 func (n *WsNode) Go() *rua.Handle {
-	readerStopper := make(chan bool)
-	writerStopper := make(chan bool)
+	stopped := make(chan bool)
+	once := &sync.Once{}
+	// close the connection and stop all threads
+	shutdown := func() {
+		once.Do(func() {
+			close(stopped)
+			n.c.Close()
+		})
+	}
+
+	var missed uint32 = 0
+	n.c.SetPongHandler(func(string) error {
+		atomic.StoreUint32(&missed, 0)
+		// a pong is activity like `TcpNode` heartbeat frames
+		if n.readTimeoutMs != 0 {
+			n.c.SetReadDeadline(time.Now().Add(time.Duration(n.readTimeoutMs) * time.Millisecond))
+		}
+		return nil
+	})
 
 	// stopper thread
 	go func() {
 		payload := <-n.stopRx
-		readerStopper <- true
-		writerStopper <- true
+		shutdown()
 		payload.Callback(nil)
 	}()
 
 	// reader thread
 	go func() {
-		loop := true
-		for loop {
-			select {
-			case <-readerStopper:
-				loop = false
-			default:
-				_, msg, err := n.c.ReadMessage()
-				if len(msg) == 0 || err != nil {
-					loop = false
-				} else {
-					n.msgHandler([]byte(msg))
-				}
+		for {
+			if n.readTimeoutMs != 0 {
+				n.c.SetReadDeadline(time.Now().Add(time.Duration(n.readTimeoutMs) * time.Millisecond))
+			}
+			_, msg, err := n.c.ReadMessage()
+			if err != nil {
+				shutdown()
+				return
+			}
+			if len(msg) != 0 {
+				n.msgHandler(msg)
 			}
 		}
-		writerStopper <- true
 	}()
 
+	// ping thread
+	if n.pingIntervalMs != 0 {
+		go func() {
+			interval := time.Duration(n.pingIntervalMs) * time.Millisecond
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopped:
+					return
+				case <-ticker.C:
+					// pings sent before are not answered during the interval, at least one ping is sent
+					if m := atomic.LoadUint32(&missed); m != 0 && m >= n.maxMissedPongs {
+						shutdown()
+						return
+					}
+					atomic.AddUint32(&missed, 1)
+					// WriteControl can be called concurrently with other write methods
+					if err := n.c.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+						shutdown()
+						return
+					}
+				}
+			}
+		}()
+	}
+
 	// writer thread
 	go func() {
 		loop := true
 		for loop {
 			select {
-			case <-writerStopper:
+			case <-stopped:
 				loop = false
 			case payload := <-n.rx:
+				if n.writeTimeoutMs != 0 {
+					n.c.SetWriteDeadline(time.Now().Add(time.Duration(n.writeTimeoutMs) * time.Millisecond))
+				}
 				err := n.c.WriteMessage(websocket.BinaryMessage, payload.Data)
 				payload.Callback(err)
 				if err != nil {
+					shutdown()
 					loop = false
 				}
 			}
 		}
+
+		// fail queued and later writes, so writers like `rua.Broadcaster` can drop this node
+		for {
+			payload := <-n.rx
+			payload.Callback(rua.ErrNodeStopped)
+		}
 	}()
 
 	return n.handle
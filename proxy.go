@@ -0,0 +1,182 @@
+package rua
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ProxyProtocolMode int
+
+const (
+	// Don't parse the PROXY protocol header.
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// Parse the header if it exists.
+	ProxyProtocolOptional
+	// Reject connections without a valid header.
+	ProxyProtocolStrict
+)
+
+var (
+	ErrProxyHeaderMissing = errors.New("missing proxy protocol header")
+	ErrProxyHeaderInvalid = errors.New("invalid proxy protocol header")
+	ErrProxyUntrusted     = errors.New("proxy protocol header from untrusted source")
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A connection whose addresses are from the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Read the PROXY protocol v1 or v2 header, return a connection which reports the real addresses.
+// Only headers from `trusted` sources are parsed.
+func readProxyHeader(conn net.Conn, mode ProxyProtocolMode, trusted []*net.IPNet, timeoutMs uint64) (net.Conn, error) {
+	if ip := remoteIp(conn.RemoteAddr()); ip == nil || !matchCidrs(ip, trusted) {
+		if mode == ProxyProtocolStrict {
+			return nil, ErrProxyUntrusted
+		}
+		return conn, nil
+	}
+
+	if timeoutMs != 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(timeoutMs) * time.Millisecond))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	reader := bufio.NewReader(conn)
+	result := &proxyConn{Conn: conn, reader: reader, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		// the client may wait for the server to speak first, nothing is buffered yet
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && mode == ProxyProtocolOptional {
+			return conn, nil
+		}
+		return nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		if prefix, err := reader.Peek(6); err == nil && string(prefix) == "PROXY " {
+			return result, parseProxyV1(reader, result)
+		}
+	case '\r':
+		if prefix, err := reader.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+			return result, parseProxyV2(reader, result)
+		}
+	}
+
+	if mode == ProxyProtocolStrict {
+		return nil, ErrProxyHeaderMissing
+	}
+	return result, nil
+}
+
+// Format: `PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n` or `PROXY UNKNOWN ...\r\n`.
+func parseProxyV1(reader *bufio.Reader, conn *proxyConn) error {
+	line := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) > 107 { // max length defined by the spec
+			return ErrProxyHeaderInvalid
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrProxyHeaderInvalid
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil // keep the original addresses
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrProxyHeaderInvalid
+	}
+
+	srcIp := net.ParseIP(fields[2])
+	dstIp := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIp == nil || dstIp == nil || err1 != nil || err2 != nil {
+		return ErrProxyHeaderInvalid
+	}
+
+	conn.remote = &net.TCPAddr{IP: srcIp, Port: int(srcPort)}
+	conn.local = &net.TCPAddr{IP: dstIp, Port: int(dstPort)}
+	return nil
+}
+
+func parseProxyV2(reader *bufio.Reader, conn *proxyConn) error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if verCmd>>4 != 2 {
+		return ErrProxyHeaderInvalid
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return err
+	}
+
+	switch verCmd & 0x0f {
+	case 0: // LOCAL, e.g. health checks from the proxy itself
+		return nil
+	case 1: // PROXY
+	default:
+		return ErrProxyHeaderInvalid
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return ErrProxyHeaderInvalid
+		}
+		conn.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		conn.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return ErrProxyHeaderInvalid
+		}
+		conn.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		conn.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	default:
+		// AF_UNSPEC or AF_UNIX, keep the original addresses
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package rua
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(cmd, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	v4 := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0x00, 0x50}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x00, 0x50)
+
+	tests := []struct {
+		name   string
+		input  []byte
+		remote string // empty means the original address is kept
+		local  string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345 80\r\n"), "10.0.0.1:12345", "10.0.0.2:80", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"), "[2001:db8::1]:12345", "[2001:db8::2]:80", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", false},
+		{"v1 missing cr", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345 80\n"), "", "", true},
+		{"v1 bad ip", []byte("PROXY TCP4 10.0.0 10.0.0.2 12345 80\r\n"), "", "", true},
+		{"v1 bad port", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 123456 80\r\n"), "", "", true},
+		{"v1 bad protocol", []byte("PROXY UDP4 10.0.0.1 10.0.0.2 12345 80\r\n"), "", "", true},
+		{"v1 too long", append([]byte("PROXY "), bytes.Repeat([]byte("a"), 200)...), "", "", true},
+		{"v1 truncated", []byte("PROXY TCP4 10.0.0.1"), "", "", true},
+		{"v2 inet", proxyV2Header(1, 0x11, v4), "10.0.0.1:12345", "10.0.0.2:80", false},
+		{"v2 inet6", proxyV2Header(1, 0x21, v6), "[2001:db8::1]:12345", "[2001:db8::2]:80", false},
+		{"v2 local", proxyV2Header(0, 0x11, v4), "", "", false},
+		{"v2 unspec", proxyV2Header(1, 0x00, nil), "", "", false},
+		{"v2 short inet", proxyV2Header(1, 0x11, v4[:8]), "", "", true},
+		{"v2 bad command", proxyV2Header(2, 0x11, v4), "", "", true},
+		{"v2 truncated", proxyV2Header(1, 0x11, v4)[:20], "", "", true},
+	}
+
+	original := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(tt.input))
+			conn := &proxyConn{reader: reader, remote: original, local: original}
+			var err error
+			if tt.input[0] == 'P' {
+				err = parseProxyV1(reader, conn)
+			} else {
+				err = parseProxyV2(reader, conn)
+			}
+
+			if tt.err {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote, local := tt.remote, tt.local
+			if remote == "" {
+				remote, local = original.String(), original.String()
+			}
+			if conn.remote.String() != remote || conn.local.String() != local {
+				t.Fatalf("want %s -> %s, got %s -> %s", remote, local, conn.remote, conn.local)
+			}
+		})
+	}
+}
+
+// A pipe which reports a TCP remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedAddr := &net.TCPAddr{IP: net.IPv4(10, 1, 1, 1), Port: 1000}
+	untrustedAddr := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1000}
+
+	tests := []struct {
+		name   string
+		mode   ProxyProtocolMode
+		remote net.Addr
+		input  string // written by the client before closing, empty means the client waits
+		want   string // expected remote address
+		rest   string // expected data after the header
+		err    error
+	}{
+		{"strict", ProxyProtocolStrict, trustedAddr, "PROXY TCP4 1.2.3.4 10.0.0.2 5 80\r\nhello", "1.2.3.4:5", "hello", nil},
+		{"strict missing header", ProxyProtocolStrict, trustedAddr, "hello", "", "", ErrProxyHeaderMissing},
+		{"strict untrusted", ProxyProtocolStrict, untrustedAddr, "PROXY TCP4 1.2.3.4 10.0.0.2 5 80\r\n", "", "", ErrProxyUntrusted},
+		{"optional", ProxyProtocolOptional, trustedAddr, "PROXY TCP4 1.2.3.4 10.0.0.2 5 80\r\nhello", "1.2.3.4:5", "hello", nil},
+		{"optional missing header", ProxyProtocolOptional, trustedAddr, "hello", trustedAddr.String(), "hello", nil},
+		{"optional untrusted", ProxyProtocolOptional, untrustedAddr, "PROXY TCP4 1.2.3.4 10.0.0.2 5 80\r\n", untrustedAddr.String(), "PROXY TCP4 1.2.3.4 10.0.0.2 5 80\r\n", nil},
+		{"optional silent client", ProxyProtocolOptional, trustedAddr, "", trustedAddr.String(), "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			if tt.input != "" {
+				go func(input string) {
+					client.Write([]byte(input))
+					client.Close()
+				}(tt.input)
+			}
+
+			conn, err := readProxyHeader(&addrConn{Conn: server, remote: tt.remote}, tt.mode, []*net.IPNet{trusted}, 100)
+			if err != tt.err {
+				t.Fatalf("want %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if conn.RemoteAddr().String() != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, conn.RemoteAddr())
+			}
+			if tt.input != "" {
+				if got, _ := ioutil.ReadAll(conn); string(got) != tt.rest {
+					t.Fatalf("want %q after the header, got %q", tt.rest, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package rua
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RotateInterval int
+
+const (
+	RotateNever RotateInterval = iota
+	RotateHourly
+	RotateDaily
+)
+
+const (
+	DefaultRotatedName       = "{name}-{time}{ext}"
+	DefaultRotatedTimeLayout = "20060102T150405"
+)
+
+// Return the next rotation time after `t`, or zero time if never.
+func (i RotateInterval) next(t time.Time) time.Time {
+	switch i {
+	case RotateHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	case RotateDaily:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+func splitExt(filename string) (string, string) {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext), ext
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// Return a free name for the rotated file.
+func (n *FileNode) rotatedFilename(opened time.Time) (string, error) {
+	name, ext := splitExt(n.filename)
+	base := strings.NewReplacer(
+		"{name}", name,
+		"{ext}", ext,
+		"{time}", opened.Format(n.timeLayout),
+	).Replace(n.pattern)
+
+	for index := 1; ; index++ {
+		var candidate string
+		if strings.Contains(base, "{index}") {
+			candidate = strings.Replace(base, "{index}", strconv.Itoa(index), -1)
+		} else if index == 1 {
+			candidate = base
+		} else {
+			candidate = base + "." + strconv.Itoa(index-1)
+		}
+		if candidate != n.filename && !fileExists(candidate) && !fileExists(candidate+".gz") {
+			return candidate, nil
+		}
+	}
+}
+
+// Escape glob meta characters.
+func globEscape(s string) string {
+	return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(s)
+}
+
+// Return true if the name can be produced by `rotatedFilename`, optionally compressed.
+func (n *FileNode) isRotatedName(path string) bool {
+	name, ext := splitExt(n.filename)
+	expr := regexp.QuoteMeta(n.pattern)
+	expr = strings.NewReplacer(
+		regexp.QuoteMeta("{name}"), regexp.QuoteMeta(name),
+		regexp.QuoteMeta("{ext}"), regexp.QuoteMeta(ext),
+		regexp.QuoteMeta("{time}"), "(.+?)",
+		regexp.QuoteMeta("{index}"), "[0-9]+",
+	).Replace(expr)
+	if !strings.Contains(n.pattern, "{index}") {
+		expr += `(\.[0-9]+)?`
+	}
+	re, err := regexp.Compile("^" + expr + `(\.gz)?$`)
+	if err != nil {
+		return false
+	}
+
+	match := re.FindStringSubmatch(path)
+	if match == nil {
+		return false
+	}
+	// every `{time}` should be parsed by the layout
+	for i := 1; i <= strings.Count(n.pattern, "{time}"); i++ {
+		if _, err := time.ParseInLocation(n.timeLayout, match[i], time.Local); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type rotatedFile struct {
+	name string
+	info os.FileInfo
+}
+
+// Return rotated files sorted from the newest to the oldest.
+func (n *FileNode) rotatedFiles() ([]*rotatedFile, error) {
+	name, ext := splitExt(n.filename)
+	glob := strings.NewReplacer(
+		"{name}", globEscape(name),
+		"{ext}", globEscape(ext),
+		"{time}", "*",
+		"{index}", "*",
+	).Replace(n.pattern)
+
+	seen := map[string]bool{n.filename: true}
+	result := []*rotatedFile{}
+	// also match index suffixes and compressed files
+	for _, g := range []string{glob, glob + ".*"} {
+		matches, err := filepath.Glob(g)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			// the glob also matches unrelated files, e.g. `app-server.log` for `app-*.log`
+			if !n.isRotatedName(m) {
+				continue
+			}
+			if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+				result = append(result, &rotatedFile{name: m, info: info})
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].info.ModTime().After(result[j].info.ModTime())
+	})
+	return result, nil
+}
+
+// Compress the rotated file and prune old files.
+func (n *FileNode) maintain(rotated string) {
+	if n.compress {
+		if err := gzipFile(rotated); err != nil {
+			n.errorHandler(err)
+		}
+	}
+
+	if n.maxBackups == 0 && n.maxAgeMs == 0 {
+		return
+	}
+	files, err := n.rotatedFiles()
+	if err != nil {
+		n.errorHandler(err)
+		return
+	}
+	deadline := time.Now().Add(-time.Duration(n.maxAgeMs) * time.Millisecond)
+	for i, f := range files {
+		if (n.maxBackups != 0 && i >= n.maxBackups) || (n.maxAgeMs != 0 && f.info.ModTime().Before(deadline)) {
+			if err := os.Remove(f.name); err != nil {
+				n.errorHandler(err)
+			}
+		}
+	}
+}
+
+// Replace the file with `<name>.gz`, keeping the modification time.
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, name+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(name+".gz", info.ModTime(), info.ModTime())
+	src.Close()
+	return os.Remove(name)
+}
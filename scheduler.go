@@ -0,0 +1,406 @@
+package rua
+
+import (
+	"container/heap"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type jobKind int
+
+const (
+	jobOnce jobKind = iota
+	jobFixedDelay
+	jobCron
+)
+
+type job struct {
+	id    uint64
+	kind  jobKind
+	next  time.Time
+	delay time.Duration
+	cron  *CronSchedule
+	f     func()
+	done  bool // finished or cancelled
+	index int  // index in the heap, -1 means not in the heap
+}
+
+type jobHeap []*job
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *jobHeap) Push(x interface{}) {
+	j := x.(*job)
+	j.index = len(*h)
+	*h = append(*h, j)
+}
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	j := old[n-1]
+	old[n-1] = nil
+	j.index = -1
+	*h = old[:n-1]
+	return j
+}
+
+type cancelPayload struct {
+	job      *job
+	callback func(error)
+}
+
+type JobHandle struct {
+	job      *job
+	cancelTx chan *cancelPayload
+}
+
+func (h *JobHandle) Id() uint64 {
+	return h.job.id
+}
+
+func (h *JobHandle) Cancel() {
+	h.CancelThen(func(error) {})
+}
+
+// The callback will get an error if the job is already finished or cancelled.
+func (h *JobHandle) CancelThen(callback func(error)) {
+	cancelTx := h.cancelTx
+	payload := &cancelPayload{job: h.job, callback: callback}
+	go func() {
+		cancelTx <- payload
+	}()
+}
+
+type SchedulerHandle struct {
+	StopOnlyHandle
+	currentJobId *uint64
+	jobTx        chan *job
+	cancelTx     chan *cancelPayload
+}
+
+func (h *SchedulerHandle) add(j *job) *JobHandle {
+	j.id = atomic.AddUint64(h.currentJobId, 1) - 1
+	j.index = -1
+	jobTx := h.jobTx
+	go func() {
+		jobTx <- j
+	}()
+	return &JobHandle{job: j, cancelTx: h.cancelTx}
+}
+
+// Run `f` once after `delayMs`.
+func (h *SchedulerHandle) After(delayMs uint64, f func()) *JobHandle {
+	delay := time.Duration(delayMs) * time.Millisecond
+	return h.add(&job{kind: jobOnce, next: time.Now().Add(delay), f: f})
+}
+
+// Run `f` once at `t`.
+func (h *SchedulerHandle) At(t time.Time, f func()) *JobHandle {
+	return h.add(&job{kind: jobOnce, next: t, f: f})
+}
+
+// Run `f` repeatedly, the next run will start `delayMs` after the previous run finished.
+func (h *SchedulerHandle) Every(delayMs uint64, f func()) *JobHandle {
+	delay := time.Duration(delayMs) * time.Millisecond
+	return h.add(&job{kind: jobFixedDelay, next: time.Now().Add(delay), delay: delay, f: f})
+}
+
+// Run `f` according to a cron expression. See `ParseCron`.
+func (h *SchedulerHandle) Cron(expr string, f func()) (*JobHandle, error) {
+	schedule, err := ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	return h.add(&job{kind: jobCron, cron: schedule, f: f}), nil
+}
+
+func (h *SchedulerHandle) WriteAfter(delayMs uint64, target *Handle, data []byte) *JobHandle {
+	return h.After(delayMs, func() { target.Write(data) })
+}
+
+func (h *SchedulerHandle) WriteAt(t time.Time, target *Handle, data []byte) *JobHandle {
+	return h.At(t, func() { target.Write(data) })
+}
+
+func (h *SchedulerHandle) WriteEvery(delayMs uint64, target *Handle, data []byte) *JobHandle {
+	return h.Every(delayMs, func() { target.Write(data) })
+}
+
+func (h *SchedulerHandle) WriteCron(expr string, target *Handle, data []byte) (*JobHandle, error) {
+	return h.Cron(expr, func() { target.Write(data) })
+}
+
+type Scheduler struct {
+	handle   *SchedulerHandle
+	location *time.Location
+	stopRx   chan *StopPayload
+	jobRx    chan *job
+	cancelRx chan *cancelPayload
+}
+
+func NewScheduler() *Scheduler {
+	stopChan := make(chan *StopPayload)
+	jobChan := make(chan *job)
+	cancelChan := make(chan *cancelPayload)
+
+	stopOnly, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
+	return &Scheduler{
+		handle: &SchedulerHandle{
+			StopOnlyHandle: *stopOnly,
+			currentJobId:   new(uint64),
+			jobTx:          jobChan,
+			cancelTx:       cancelChan,
+		},
+		location: time.Local,
+		stopRx:   stopChan,
+		jobRx:    jobChan,
+		cancelRx: cancelChan,
+	}
+}
+
+// Set the time zone of cron jobs. Default is `time.Local`.
+func (s *Scheduler) Location(loc *time.Location) *Scheduler {
+	s.location = loc
+	return s
+}
+
+func (s *Scheduler) Handle() *SchedulerHandle {
+	return s.handle
+}
+
+func (s *Scheduler) Go() *SchedulerHandle {
+	go func() {
+		queue := &jobHeap{}
+		doneChan := make(chan *job)
+		stopped := make(chan bool)
+		defer close(stopped)
+		timer := time.NewTimer(time.Hour)
+		defer timer.Stop()
+
+		schedule := func(j *job) {
+			if j.kind == jobCron {
+				j.next = j.cron.Next(time.Now().In(s.location))
+				if j.next.IsZero() {
+					j.done = true
+					return
+				}
+			}
+			heap.Push(queue, j)
+		}
+
+		resetTimer := func() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if queue.Len() != 0 {
+				timer.Reset(time.Until((*queue)[0].next))
+			}
+		}
+
+		loop := true
+		for loop {
+			select {
+			case j := <-s.jobRx:
+				// the job may be cancelled before it arrives
+				if !j.done {
+					schedule(j)
+					resetTimer()
+				}
+			case payload := <-s.cancelRx:
+				j := payload.job
+				if j.done {
+					payload.callback(errors.New("job already finished"))
+				} else {
+					j.done = true
+					if j.index >= 0 {
+						heap.Remove(queue, j.index)
+						resetTimer()
+					}
+					payload.callback(nil)
+				}
+			case j := <-doneChan:
+				// fixed delay job finished
+				if !j.done {
+					j.next = time.Now().Add(j.delay)
+					heap.Push(queue, j)
+					resetTimer()
+				}
+			case <-timer.C:
+				now := time.Now()
+				for queue.Len() != 0 && !(*queue)[0].next.After(now) {
+					j := heap.Pop(queue).(*job)
+					switch j.kind {
+					case jobOnce:
+						j.done = true
+						go j.f()
+					case jobFixedDelay:
+						go func() {
+							j.f()
+							select {
+							case doneChan <- j:
+							case <-stopped:
+							}
+						}()
+					case jobCron:
+						go j.f()
+						schedule(j)
+					}
+				}
+				if queue.Len() != 0 {
+					timer.Reset(time.Until((*queue)[0].next))
+				}
+			case payload := <-s.stopRx:
+				payload.Callback(nil)
+				loop = false
+			}
+		}
+	}()
+
+	return s.handle
+}
+
+// A parsed cron expression.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets
+	domStar, dowStar              bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a standard 5-field cron expression: `minute hour day-of-month month day-of-week`.
+// Each field supports `*`, lists `a,b`, ranges `a-b` and steps `*/n` or `a-b/n`.
+// Day-of-week is 0-7 where both 0 and 7 are Sunday.
+// Descriptors like `@daily` and `@hourly` are also supported.
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[expr]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression should have 5 fields")
+	}
+
+	var err error
+	s := &CronSchedule{}
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 // 7 is also Sunday
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseCronField(field string, min, max uint64) (uint64, error) {
+	var bits uint64 = 0
+	for _, part := range strings.Split(field, ",") {
+		rangePart := part
+		var step uint64 = 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.ParseUint(part[i+1:], 10, 64)
+			if err != nil || s == 0 {
+				return 0, errors.New("invalid cron step: " + part)
+			}
+			step = s
+			rangePart = part[:i]
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if start, err = strconv.ParseUint(bounds[0], 10, 64); err != nil {
+				return 0, errors.New("invalid cron value: " + part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.ParseUint(bounds[1], 10, 64); err != nil {
+					return 0, errors.New("invalid cron value: " + part)
+				}
+			} else if step != 1 {
+				end = max // `a/n` means `a-max/n`
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, errors.New("cron value out of range: " + part)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	// if both fields are restricted, match either of them
+	return domMatch || dowMatch
+}
+
+// Return the first matching time after `t`, or zero time if nothing matches in 5 years.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	yearLimit := t.Year() + 5
+
+	for t.Year() <= yearLimit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,73 @@
+package rua
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	exprs := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"@every",
+	}
+
+	for _, expr := range exprs {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q: want error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", at(2024, 1, 1, 10, 7).Add(30 * time.Second), at(2024, 1, 1, 10, 8)},
+		{"*/15 * * * *", at(2024, 1, 1, 10, 7), at(2024, 1, 1, 10, 15)},
+		{"5/20 * * * *", at(2024, 1, 1, 10, 6), at(2024, 1, 1, 10, 25)},
+		{"0,30 8-9 * * *", at(2024, 1, 1, 9, 30), at(2024, 1, 2, 8, 0)},
+		{"@hourly", at(2024, 1, 1, 10, 0), at(2024, 1, 1, 11, 0)},
+		{"@daily", at(2024, 12, 31, 23, 59), at(2025, 1, 1, 0, 0)},
+		{"@monthly", at(2024, 1, 31, 0, 0), at(2024, 2, 1, 0, 0)},
+		// 2024-01-06 is Saturday
+		{"0 9 * * 1-5", at(2024, 1, 6, 10, 0), at(2024, 1, 8, 9, 0)},
+		// both 0 and 7 are Sunday
+		{"0 0 * * 7", at(2024, 1, 1, 0, 0), at(2024, 1, 7, 0, 0)},
+		{"0 0 * * 0", at(2024, 1, 1, 0, 0), at(2024, 1, 7, 0, 0)},
+		// restricted day-of-month and day-of-week match either of them
+		{"0 0 13 * 5", at(2024, 1, 1, 0, 0), at(2024, 1, 5, 0, 0)},
+		{"0 0 13 * 5", at(2024, 1, 12, 0, 0), at(2024, 1, 13, 0, 0)},
+		// only in leap years
+		{"0 0 29 2 *", at(2023, 3, 1, 0, 0), at(2024, 2, 29, 0, 0)},
+		// never matches
+		{"0 0 31 2 *", at(2024, 1, 1, 0, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q from %v: want %v, got %v", tt.expr, tt.from, tt.want, got)
+		}
+	}
+}
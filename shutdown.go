@@ -0,0 +1,205 @@
+package rua
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Anything which can be stopped with a callback, e.g. `*Handle` and `*StopOnlyHandle`.
+type Stopper interface {
+	StopThen(callback func(error))
+}
+
+type shutdownEntry struct {
+	phase int
+	name  string
+	stop  func(callback func(error))
+}
+
+type ShutdownFailure struct {
+	Phase int
+	Name  string
+	Err   error
+}
+
+type ShutdownReport struct {
+	Failures []*ShutdownFailure
+}
+
+func (r *ShutdownReport) Ok() bool {
+	return len(r.Failures) == 0
+}
+
+// Stop registered nodes phase by phase, phases with smaller numbers are stopped first.
+// Nodes in the same phase are stopped concurrently.
+type Shutdown struct {
+	entries          []*shutdownEntry
+	phaseTimeoutMs   map[int]uint64
+	defaultTimeoutMs uint64
+	signals          []os.Signal
+	forceExitCode    int
+	doneHandler      func(*ShutdownReport)
+	lock             *sync.Mutex
+}
+
+func NewShutdown() *Shutdown {
+	return &Shutdown{
+		entries:          []*shutdownEntry{},
+		phaseTimeoutMs:   make(map[int]uint64),
+		defaultTimeoutMs: 5000,
+		signals:          []os.Signal{os.Interrupt, syscall.SIGTERM},
+		forceExitCode:    1,
+		doneHandler:      func(*ShutdownReport) {},
+		lock:             &sync.Mutex{},
+	}
+}
+
+// Timeout of phases without a specific timeout. Default is 5000.
+func (s *Shutdown) DefaultPhaseTimeoutMs(ms uint64) *Shutdown {
+	s.defaultTimeoutMs = ms
+	return s
+}
+
+func (s *Shutdown) PhaseTimeoutMs(phase int, ms uint64) *Shutdown {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.phaseTimeoutMs[phase] = ms
+	return s
+}
+
+// Signals which will trigger the shutdown in `Wait`. Default is `os.Interrupt` and `SIGTERM`.
+func (s *Shutdown) Signals(sigs ...os.Signal) *Shutdown {
+	s.signals = sigs
+	return s
+}
+
+// Exit code when the process is forced to exit by a second signal. Default is 1.
+func (s *Shutdown) ForceExitCode(code int) *Shutdown {
+	s.forceExitCode = code
+	return s
+}
+
+func (s *Shutdown) OnDone(f func(*ShutdownReport)) *Shutdown {
+	s.doneHandler = f
+	return s
+}
+
+func (s *Shutdown) Register(phase int, name string, target Stopper) *Shutdown {
+	return s.RegisterFunc(phase, name, target.StopThen)
+}
+
+// Register a custom stop function, it should call the callback once the target is stopped.
+func (s *Shutdown) RegisterFunc(phase int, name string, stop func(callback func(error))) *Shutdown {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = append(s.entries, &shutdownEntry{phase: phase, name: name, stop: stop})
+	return s
+}
+
+// Stop all registered nodes and block until all phases are done.
+func (s *Shutdown) Run() *ShutdownReport {
+	s.lock.Lock()
+	phases := make(map[int][]*shutdownEntry)
+	for _, e := range s.entries {
+		phases[e.phase] = append(phases[e.phase], e)
+	}
+	timeouts := make(map[int]uint64)
+	for phase, ms := range s.phaseTimeoutMs {
+		timeouts[phase] = ms
+	}
+	s.lock.Unlock()
+
+	order := make([]int, 0, len(phases))
+	for phase := range phases {
+		order = append(order, phase)
+	}
+	sort.Ints(order)
+
+	report := &ShutdownReport{Failures: []*ShutdownFailure{}}
+	for _, phase := range order {
+		timeoutMs, ok := timeouts[phase]
+		if !ok {
+			timeoutMs = s.defaultTimeoutMs
+		}
+		report.Failures = append(report.Failures, runShutdownPhase(phase, phases[phase], timeoutMs)...)
+	}
+
+	s.doneHandler(report)
+	return report
+}
+
+func runShutdownPhase(phase int, entries []*shutdownEntry, timeoutMs uint64) []*ShutdownFailure {
+	type result struct {
+		index int
+		err   error
+	}
+
+	results := make(chan result, len(entries))
+	for i, e := range entries {
+		i := i
+		once := &sync.Once{}
+		e.stop(func(err error) {
+			once.Do(func() {
+				results <- result{index: i, err: err}
+			})
+		})
+	}
+
+	failures := []*ShutdownFailure{}
+	done := make([]bool, len(entries))
+	timeout := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer timeout.Stop()
+
+	for remaining := len(entries); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			done[r.index] = true
+			if r.err != nil {
+				failures = append(failures, &ShutdownFailure{Phase: phase, Name: entries[r.index].name, Err: r.err})
+			}
+		case <-timeout.C:
+			for i, e := range entries {
+				if !done[i] {
+					failures = append(failures, &ShutdownFailure{Phase: phase, Name: e.name, Err: errors.New("stop timeout")})
+				}
+			}
+			return failures
+		}
+	}
+	return failures
+}
+
+// Block until a signal is received, then run the shutdown.
+// If another signal is received during the shutdown, the process will exit immediately.
+func (s *Shutdown) Wait() *ShutdownReport {
+	var report *ShutdownReport
+	done := make(chan bool)
+	started := false
+
+	node := NewSignalNode()
+	handler := func(os.Signal) {
+		if started {
+			os.Exit(s.forceExitCode)
+		}
+		started = true
+		go func() {
+			report = s.Run()
+			node.Handle().Stop()
+			done <- true
+		}()
+	}
+	for _, sig := range s.signals {
+		node.On(sig, handler)
+	}
+
+	if err := node.Wait(); err != nil {
+		// no signals to wait
+		return s.Run()
+	}
+	<-done
+	return report
+}
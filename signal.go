@@ -0,0 +1,88 @@
+package rua
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+)
+
+type SignalNode struct {
+	handlers map[os.Signal]func(os.Signal)
+	once     bool
+	handle   *StopOnlyHandle
+	stopRx   chan *StopPayload
+}
+
+func NewSignalNode() *SignalNode {
+	stopChan := make(chan *StopPayload)
+	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
+	return &SignalNode{
+		handlers: make(map[os.Signal]func(os.Signal)),
+		once:     false,
+		handle:   handle,
+		stopRx:   stopChan,
+	}
+}
+
+// Set the handler of a signal. The handler will be called every time the signal is received.
+func (n *SignalNode) On(sig os.Signal, f func(os.Signal)) *SignalNode {
+	n.handlers[sig] = f
+	return n
+}
+
+// Stop the node after the first signal is handled. Default is false.
+func (n *SignalNode) Once(enable bool) *SignalNode {
+	n.once = enable
+	return n
+}
+
+func (n *SignalNode) Handle() *StopOnlyHandle {
+	return n.handle
+}
+
+// Return error if missing handlers.
+func (n *SignalNode) Go() (*StopOnlyHandle, error) {
+	if len(n.handlers) == 0 {
+		return nil, errors.New("missing handlers")
+	}
+
+	go n.loop()
+
+	return n.handle, nil
+}
+
+// Like `Go`, but block until the node is stopped.
+// Return error if missing handlers.
+func (n *SignalNode) Wait() error {
+	if len(n.handlers) == 0 {
+		return errors.New("missing handlers")
+	}
+
+	n.loop()
+	return nil
+}
+
+func (n *SignalNode) loop() {
+	sigs := make([]os.Signal, 0, len(n.handlers))
+	for sig := range n.handlers {
+		sigs = append(sigs, sig)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+
+	loop := true
+	for loop {
+		select {
+		case sig := <-ch:
+			n.handlers[sig](sig)
+			if n.once {
+				loop = false
+			}
+		case payload := <-n.stopRx:
+			payload.Callback(nil)
+			loop = false
+		}
+	}
+}
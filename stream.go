@@ -0,0 +1,435 @@
+package rua
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamNode reads frames from an `io.Reader` and writes frames to an `io.Writer`.
+type StreamNode struct {
+	handle        *Handle
+	reader        io.Reader // nil means write only
+	writer        io.Writer // nil means read only
+	closer        io.Closer // closed when the node is stopped
+	codec         Codec
+	maxFrameSize  int
+	readMs        uint64
+	writeMs       uint64
+	heartbeat     *Heartbeat
+	stopOnReadEnd bool
+	maxBatchSize  int
+	flushMs       uint64
+	started       int32
+	closeHandler  func() // called when the node is stopped
+	inputHandler  func([]byte)
+	rx            chan *WritePayload
+	stopRx        chan *StopPayload
+}
+
+// Either `reader` or `writer` can be nil.
+func NewStreamNode(reader io.Reader, writer io.Writer, buffer uint) *StreamNode {
+	msgChan := make(chan *WritePayload, buffer)
+	stopChan := make(chan *StopPayload)
+
+	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
+	return &StreamNode{
+		handle:        handle,
+		reader:        reader,
+		writer:        writer,
+		closer:        nil,
+		codec:         LineCodec(),
+		maxFrameSize:  0,
+		readMs:        0,
+		writeMs:       0,
+		heartbeat:     nil,
+		stopOnReadEnd: true,
+		maxBatchSize:  65536,
+		flushMs:       0,
+		started:       0,
+		closeHandler:  func() {},
+		inputHandler:  func(b []byte) {},
+		rx:            msgChan,
+		stopRx:        stopChan,
+	}
+}
+
+// Read from and write to the stream, the stream will be closed when the node is stopped.
+func NewReadWriteCloserNode(rwc io.ReadWriteCloser, buffer uint) *StreamNode {
+	return NewStreamNode(rwc, rwc, buffer).Closer(rwc)
+}
+
+// Start the command, read from its stdout and write to its stdin.
+// The command will be killed when the node is stopped.
+func NewCmdNode(cmd *exec.Cmd, buffer uint) (*StreamNode, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return NewStreamNode(stdout, stdin, buffer).Closer(&cmdCloser{cmd: cmd, stdin: stdin}), nil
+}
+
+type cmdCloser struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+func (c *cmdCloser) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+// The closer will be closed when the node is stopped, which also unblocks the reader.
+func (n *StreamNode) Closer(c io.Closer) *StreamNode {
+	n.closer = c
+	return n
+}
+
+// Set the framing codec. Default is `LineCodec`.
+func (n *StreamNode) Codec(c Codec) *StreamNode {
+	n.codec = c
+	return n
+}
+
+// Frames larger than the size will be rejected and the node will stop reading. Default is 0 which means no limit.
+func (n *StreamNode) MaxFrameSize(size int) *StreamNode {
+	n.maxFrameSize = size
+	return n
+}
+
+// The node will be stopped if nothing is received during the timeout. Default is 0 which means no timeout.
+// Only works if the reader has `SetReadDeadline`, e.g. `net.Conn` and `*os.File`.
+func (n *StreamNode) ReadTimeoutMs(ms uint64) *StreamNode {
+	n.readMs = ms
+	return n
+}
+
+// The node will be stopped if a write can't finish during the timeout. Default is 0 which means no timeout.
+// Only works if the writer has `SetWriteDeadline`, e.g. `net.Conn` and `*os.File`.
+func (n *StreamNode) WriteTimeoutMs(ms uint64) *StreamNode {
+	n.writeMs = ms
+	return n
+}
+
+// Default is nil which means no heartbeat.
+func (n *StreamNode) Heartbeat(h *Heartbeat) *StreamNode {
+	n.heartbeat = h
+	return n
+}
+
+// Stop the node when the reader returns an error, e.g. EOF. Default is true.
+// If false, only reading is stopped and the node can still write.
+func (n *StreamNode) StopOnReadEnd(enable bool) *StreamNode {
+	n.stopOnReadEnd = enable
+	return n
+}
+
+// Queued writes are coalesced into one batch until the batch reaches the size. Default is 65536, 0 means no limit.
+func (n *StreamNode) MaxBatchSize(size int) *StreamNode {
+	n.maxBatchSize = size
+	return n
+}
+
+// Wait at most `ms` for more writes before flushing a batch.
+// Default is 0 which means flush as soon as the write queue is empty.
+func (n *StreamNode) FlushLatencyMs(ms uint64) *StreamNode {
+	n.flushMs = ms
+	return n
+}
+
+func (n *StreamNode) OnInput(f func([]byte)) *StreamNode {
+	n.inputHandler = f
+	return n
+}
+
+func (n *StreamNode) Handle() *Handle {
+	return n.handle
+}
+
+func (n *StreamNode) close() error {
+	if n.closer == nil {
+		return nil
+	}
+	return n.closer.Close()
+}
+
+// Stop the node even if it's not started.
+func (n *StreamNode) stopThen(callback func(error)) {
+	if atomic.LoadInt32(&n.started) == 0 {
+		err := n.close()
+		n.closeHandler()
+		callback(err)
+	} else {
+		n.handle.StopThen(callback)
+	}
+}
+
+func (n *StreamNode) Go() *Handle {
+	atomic.StoreInt32(&n.started, 1)
+	stopped := make(chan bool)
+	once := &sync.Once{}
+	// close the stream and stop all threads
+	shutdown := func() {
+		once.Do(func() {
+			close(stopped)
+			n.close()
+			n.closeHandler()
+		})
+	}
+
+	// stopper thread, later stop requests are answered by the writer thread
+	go func() {
+		select {
+		case payload := <-n.stopRx:
+			shutdown()
+			payload.Callback(nil)
+		case <-stopped:
+		}
+	}()
+
+	var missed uint32 = 0
+
+	// reader thread
+	if n.reader != nil {
+		readDeadline, _ := n.reader.(interface{ SetReadDeadline(time.Time) error })
+		go func() {
+			reader := bufio.NewReader(n.reader)
+			for {
+				if n.readMs != 0 && readDeadline != nil {
+					readDeadline.SetReadDeadline(time.Now().Add(time.Duration(n.readMs) * time.Millisecond))
+				}
+				frame, err := n.codec.ReadFrame(reader, n.maxFrameSize)
+				if err != nil {
+					if n.stopOnReadEnd {
+						shutdown()
+					}
+					return
+				}
+				select {
+				case <-stopped:
+					// the reader may not be closable, e.g. stdin
+					return
+				default:
+				}
+				if n.heartbeat != nil {
+					if bytes.Equal(frame, n.heartbeat.Pong) {
+						atomic.StoreUint32(&missed, 0)
+						continue
+					}
+					if bytes.Equal(frame, n.heartbeat.Ping) {
+						n.handle.Write(n.heartbeat.Pong)
+						continue
+					}
+				}
+				n.inputHandler(frame)
+			}
+		}()
+	}
+
+	// heartbeat thread
+	if n.heartbeat != nil && n.heartbeat.IntervalMs != 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(n.heartbeat.IntervalMs) * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopped:
+					return
+				case <-ticker.C:
+					// pings sent before are not answered during the interval, at least one ping is sent
+					if m := atomic.LoadUint32(&missed); m != 0 && m >= n.heartbeat.MaxMissed {
+						shutdown()
+						return
+					}
+					atomic.AddUint32(&missed, 1)
+					n.handle.Write(n.heartbeat.Ping)
+				}
+			}
+		}()
+	}
+
+	// writer thread
+	go func() {
+		writeDeadline, _ := n.writer.(interface{ SetWriteDeadline(time.Time) error })
+		w := newBatchWriter(n.writer)
+		loop := true
+		for loop {
+			select {
+			case <-stopped:
+				loop = false
+			case payload := <-n.rx:
+				if n.writer == nil {
+					payload.Callback(errors.New("node is read only"))
+					break
+				}
+				batch := n.collect(payload, stopped)
+				if n.writeMs != 0 && writeDeadline != nil {
+					writeDeadline.SetWriteDeadline(time.Now().Add(time.Duration(n.writeMs) * time.Millisecond))
+				}
+				if err := n.writeBatch(w, batch); err != nil {
+					shutdown()
+					loop = false
+				}
+			}
+		}
+
+		// fail queued and later writes, so writers like `Broadcaster` can drop this node,
+		// and answer stop requests which may race with each other, e.g. from `StopPeers`
+		for {
+			select {
+			case payload := <-n.rx:
+				payload.Callback(ErrNodeStopped)
+			case payload := <-n.stopRx:
+				payload.Callback(nil)
+			}
+		}
+	}()
+
+	return n.handle
+}
+
+// Collect queued writes into a batch, starting with `first`.
+func (n *StreamNode) collect(first *WritePayload, stopped chan bool) []*WritePayload {
+	batch := []*WritePayload{first}
+	size := len(first.Data)
+
+	var timeout <-chan time.Time = nil
+	if n.flushMs != 0 {
+		timer := time.NewTimer(time.Duration(n.flushMs) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for n.maxBatchSize == 0 || size < n.maxBatchSize {
+		if timeout == nil {
+			select {
+			case payload := <-n.rx:
+				batch = append(batch, payload)
+				size += len(payload.Data)
+			default:
+				return batch
+			}
+		} else {
+			select {
+			case payload := <-n.rx:
+				batch = append(batch, payload)
+				size += len(payload.Data)
+			case <-timeout:
+				return batch
+			case <-stopped:
+				return batch
+			}
+		}
+	}
+	return batch
+}
+
+// Write the batch and call the callbacks. Return the write error which breaks the stream.
+// Frames which can't be encoded only fail their own callbacks.
+func (n *StreamNode) writeBatch(w *batchWriter, batch []*WritePayload) error {
+	encoded := make([]*WritePayload, 0, len(batch))
+	for _, payload := range batch {
+		buffers, err := n.codec.EncodeFrame(payload.Data, n.maxFrameSize)
+		if err != nil {
+			payload.Callback(err)
+			continue
+		}
+		w.add(buffers)
+		encoded = append(encoded, payload)
+	}
+	if len(encoded) == 0 {
+		return nil
+	}
+
+	err := w.flush()
+	for _, payload := range encoded {
+		payload.Callback(err)
+	}
+	return err
+}
+
+// Use writev for sockets, otherwise buffer the data and write once per batch.
+// Packet sockets keep one write per frame.
+type batchWriter struct {
+	vectored io.Writer
+	packet   bool
+	buffers  net.Buffers
+	buffered *bufio.Writer
+}
+
+func newBatchWriter(w io.Writer) *batchWriter {
+	if w == nil {
+		return nil
+	}
+	if conn := socketConn(w); conn != nil {
+		packet := conn.LocalAddr().Network() == "unixpacket"
+		return &batchWriter{vectored: conn, packet: packet, buffers: nil, buffered: nil}
+	}
+	return &batchWriter{vectored: nil, packet: false, buffers: nil, buffered: bufio.NewWriterSize(w, 65536)}
+}
+
+// Return the underlying socket which supports writev, or nil.
+func socketConn(w io.Writer) net.Conn {
+	for {
+		switch c := w.(type) {
+		case *net.TCPConn:
+			return c
+		case *net.UnixConn:
+			return c
+		case *proxyConn:
+			w = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+func (w *batchWriter) add(buffers net.Buffers) {
+	if w.packet {
+		w.buffers = append(w.buffers, bytes.Join(buffers, nil))
+		return
+	}
+	if w.vectored != nil {
+		w.buffers = append(w.buffers, buffers...)
+		return
+	}
+	for _, b := range buffers {
+		// the error is kept by the writer and returned by `Flush`
+		w.buffered.Write(b)
+	}
+}
+
+func (w *batchWriter) flush() error {
+	if w.packet {
+		buffers := w.buffers
+		w.buffers = nil
+		for _, b := range buffers {
+			if _, err := w.vectored.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if w.vectored != nil {
+		buffers := w.buffers
+		w.buffers = nil
+		_, err := buffers.WriteTo(w.vectored)
+		return err
+	}
+	return w.buffered.Flush()
+}
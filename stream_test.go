@@ -0,0 +1,53 @@
+package rua
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamNodeAnswersEveryStop(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	node := NewReadWriteCloserNode(a, 4)
+	node.Go()
+
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		node.stopThen(func(err error) { done <- err })
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stop request %d was never answered", i)
+		}
+	}
+}
+
+func TestTcpListenerStopPeersRacesWithPeerStop(t *testing.T) {
+	peers := make(chan *TcpNode, 1)
+	l := NewTcpListener("127.0.0.1:0").StopPeers(true).OnNewPeer(func(peer *TcpNode) {
+		peer.Go()
+		peers <- peer
+	})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	defer conn.Close()
+	peer := <-peers
+
+	done := make(chan bool)
+	peer.Handle().Stop()
+	h.StopThen(func(error) { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener stop hangs")
+	}
+}
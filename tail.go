@@ -2,18 +2,88 @@ package rua
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"time"
 )
 
+// Wake the tail node when the file may have changed.
+type tailWatcher interface {
+	wake() <-chan bool
+	close() error
+}
+
+type pollWatcher struct {
+	ticker *time.Ticker
+	wakeC  chan bool
+	done   chan bool
+}
+
+func newPollWatcher(intervalMs uint64) *pollWatcher {
+	if intervalMs == 0 {
+		intervalMs = 10
+	}
+	w := &pollWatcher{
+		ticker: time.NewTicker(time.Duration(intervalMs) * time.Millisecond),
+		wakeC:  make(chan bool, 1),
+		done:   make(chan bool),
+	}
+	go func() {
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-w.ticker.C:
+				select {
+				case w.wakeC <- true:
+				default:
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) wake() <-chan bool {
+	return w.wakeC
+}
+
+func (w *pollWatcher) close() error {
+	w.ticker.Stop()
+	close(w.done)
+	return nil
+}
+
+type tailStart int
+
+const (
+	tailFromEnd tailStart = iota
+	tailFromBeginning
+	tailFromOffset
+	tailFromLastLines
+)
+
+type tailCheckpoint struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
 type TailNode struct {
 	handle          *StopOnlyHandle
 	filename        string
 	stopRx          chan *StopPayload
 	lineHandler     func([]byte)
 	checkIntervalMs uint64
+	polling         bool
+	followName      bool
+	start           tailStart
+	startOffset     int64
+	startLines      int
+	checkpoint      string
+	errorHandler    func(error)
 }
 
 func NewTailNode(filename string) *TailNode {
@@ -25,6 +95,13 @@ func NewTailNode(filename string) *TailNode {
 		lineHandler:     nil,
 		stopRx:          stopChan,
 		checkIntervalMs: 10,
+		polling:         false,
+		followName:      false,
+		start:           tailFromEnd,
+		startOffset:     0,
+		startLines:      0,
+		checkpoint:      "",
+		errorHandler:    func(error) {},
 	}
 }
 
@@ -33,54 +110,327 @@ func (n *TailNode) OnNewLine(f func([]byte)) *TailNode {
 	return n
 }
 
+// The interval of polling. Default is 10.
 func (n *TailNode) CheckIntervalMs(ms uint64) *TailNode {
 	n.checkIntervalMs = ms
 	return n
 }
 
+// Check the file periodically instead of waiting for inotify events. Default is false.
+// Polling is always used if inotify is not available.
+func (n *TailNode) Polling(enable bool) *TailNode {
+	n.polling = enable
+	return n
+}
+
+// Follow the filename instead of the opened file, like `tail -F`. Default is false.
+// When the file is renamed or deleted, the old file is drained and the new file is read from the beginning.
+// When the file is truncated, it's read from the beginning.
+// The file doesn't need to exist when the node starts.
+func (n *TailNode) FollowName(enable bool) *TailNode {
+	n.followName = enable
+	return n
+}
+
+// Only read new lines. This is the default.
+func (n *TailNode) FromEnd() *TailNode {
+	n.start = tailFromEnd
+	return n
+}
+
+// Read the whole file.
+func (n *TailNode) FromBeginning() *TailNode {
+	n.start = tailFromBeginning
+	return n
+}
+
+// Start reading from the byte offset. If the file is shorter, start from the end.
+func (n *TailNode) FromOffset(offset int64) *TailNode {
+	n.start = tailFromOffset
+	n.startOffset = offset
+	return n
+}
+
+// Start reading from the last `count` lines, like `tail -n`.
+func (n *TailNode) FromLastLines(count int) *TailNode {
+	n.start = tailFromLastLines
+	n.startLines = count
+	return n
+}
+
+// Record the inode and the offset after the last delivered line in the file.
+// When the node starts again and the checkpoint matches the file, it resumes from the offset
+// instead of the start position. If the file is replaced or truncated, it starts from the beginning.
+// Lines are delivered at least once, since the checkpoint is written after they are handled.
+func (n *TailNode) Checkpoint(path string) *TailNode {
+	n.checkpoint = path
+	return n
+}
+
+// The handler will get errors of writing the checkpoint.
+func (n *TailNode) OnError(f func(error)) *TailNode {
+	n.errorHandler = f
+	return n
+}
+
 func (n *TailNode) Handle() *StopOnlyHandle {
 	return n.handle
 }
 
+func (n *TailNode) newWatcher() tailWatcher {
+	if !n.polling {
+		if w, err := newNotifyWatcher(n.filename, n.followName); err == nil {
+			return w
+		}
+	}
+	return newPollWatcher(n.checkIntervalMs)
+}
+
+// The file being tailed.
+type tailState struct {
+	node    *TailNode
+	file    *os.File // nil if the file doesn't exist
+	reader  *bufio.Reader
+	partial []byte // incomplete line at the end of the file
+	offset  int64  // offset of the next byte to read
+	saved   *tailCheckpoint
+}
+
+// Open the file and read it from the beginning.
+func (s *tailState) open() error {
+	file, err := os.OpenFile(s.node.filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.reader = bufio.NewReader(file)
+	s.partial = []byte{}
+	s.offset = 0
+	s.saved = nil
+	return nil
+}
+
+func (s *tailState) seek(offset int64) error {
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader.Reset(s.file)
+	s.partial = []byte{}
+	s.offset = offset
+	return nil
+}
+
+// Return the offset to start reading from.
+func (s *tailState) startOffset() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if cp := s.node.loadCheckpoint(); cp != nil {
+		if inode := fileInode(info); inode == 0 || cp.Inode == 0 || inode == cp.Inode {
+			if cp.Offset <= info.Size() {
+				return cp.Offset, nil
+			}
+		}
+		// the file is replaced or truncated after the checkpoint
+		return 0, nil
+	}
+
+	switch s.node.start {
+	case tailFromBeginning:
+		return 0, nil
+	case tailFromOffset:
+		if s.node.startOffset > info.Size() {
+			return info.Size(), nil
+		}
+		return s.node.startOffset, nil
+	case tailFromLastLines:
+		return lastLinesOffset(s.file, info.Size(), s.node.startLines)
+	}
+	return info.Size(), nil
+}
+
+// Return the offset of the last `count` lines, an incomplete last line is counted.
+func lastLinesOffset(file *os.File, size int64, count int) (int64, error) {
+	if count <= 0 {
+		return size, nil
+	}
+	buf := make([]byte, 4096)
+	pos := size
+	found := 0
+	first := true // the newline at the end of the file doesn't start a line
+	for pos > 0 {
+		chunk := int64(len(buf))
+		if pos < chunk {
+			chunk = pos
+		}
+		pos -= chunk
+		if _, err := file.ReadAt(buf[:chunk], pos); err != nil {
+			return 0, err
+		}
+		for i := chunk - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				first = false
+				continue
+			}
+			if first {
+				first = false
+				continue
+			}
+			found += 1
+			if found == count {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func (s *tailState) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Emit all complete lines.
+func (s *tailState) readLines() {
+	if s.file == nil {
+		return
+	}
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		s.offset += int64(len(line))
+		if err != nil {
+			s.partial = append(s.partial, line...)
+			s.save()
+			return
+		}
+		if len(s.partial) != 0 {
+			line = append(s.partial, line...)
+			s.partial = []byte{}
+		}
+		line = line[:len(line)-1] // remove \n
+		if len(line) != 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1] // remove \r
+		}
+		s.node.lineHandler(line)
+	}
+}
+
+// Reopen the file if it's replaced, or read it from the beginning if it's truncated.
+func (s *tailState) follow() {
+	info, statErr := os.Stat(s.node.filename)
+
+	if s.file == nil {
+		if statErr == nil && s.open() == nil {
+			s.readLines()
+		}
+		return
+	}
+
+	current, err := s.file.Stat()
+	if err != nil {
+		return
+	}
+	if statErr != nil || !os.SameFile(info, current) {
+		// drain the old file, the last line may not end with a newline
+		s.readLines()
+		if len(s.partial) != 0 {
+			s.node.lineHandler(s.partial)
+		}
+		s.close()
+		if statErr == nil && s.open() == nil {
+			s.readLines()
+		}
+		return
+	}
+	if current.Size() < s.offset {
+		if s.seek(0) == nil {
+			s.readLines()
+		}
+	}
+}
+
+// Return error if missing `lineHandler`, or the file can't be opened when not following the name.
 func (n *TailNode) Go() (*StopOnlyHandle, error) {
 	if n.lineHandler == nil {
 		return nil, errors.New("missing lineHandler")
 	}
 
-	file, err := os.OpenFile(n.filename, os.O_RDONLY, 0666)
-	if err != nil {
+	state := &tailState{node: n, file: nil, reader: nil, partial: []byte{}, offset: 0, saved: nil}
+	if err := state.open(); err == nil {
+		offset, err := state.startOffset()
+		if err == nil {
+			err = state.seek(offset)
+		}
+		if err != nil {
+			state.close()
+			return nil, err
+		}
+	} else if !n.followName || !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	if _, err = file.Seek(0, 2); err != nil {
-		file.Close()
-		return nil, err
-	}
+	// start watching before reading, so no write will be missed
+	watcher := n.newWatcher()
 
 	go func() {
 		loop := true
-		reader := bufio.NewReader(file)
 		for loop {
+			state.readLines()
+			if n.followName {
+				state.follow()
+			}
 			select {
 			case payload := <-n.stopRx:
-				payload.Callback(nil)
+				watcher.close()
+				payload.Callback(state.close())
 				loop = false
-			default:
-				line, err := reader.ReadString('\n')
-				if len(line) == 0 && err == io.EOF {
-					time.Sleep(time.Millisecond * time.Duration(n.checkIntervalMs))
-				} else if len(line) == 0 || err != nil {
-					loop = false
-				} else {
-					line = line[:len(line)-1] // remove \n
-					if line[len(line)-1] == '\r' {
-						line = line[:len(line)-1] // remove \r
-					}
-					n.lineHandler([]byte(line))
-				}
+			case <-watcher.wake():
 			}
 		}
 	}()
 
 	return n.handle, nil
 }
+
+func (n *TailNode) loadCheckpoint() *tailCheckpoint {
+	if len(n.checkpoint) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(n.checkpoint)
+	if err != nil {
+		return nil
+	}
+	cp := &tailCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil
+	}
+	return cp
+}
+
+// Write the checkpoint if it's changed.
+func (s *tailState) save() {
+	if len(s.node.checkpoint) == 0 || s.file == nil {
+		return
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		s.node.errorHandler(err)
+		return
+	}
+	cp := &tailCheckpoint{Inode: fileInode(info), Offset: s.offset - int64(len(s.partial))}
+	if s.saved != nil && *s.saved == *cp {
+		return
+	}
+	data, _ := json.Marshal(cp)
+	if err := writeFileAtomic(s.node.checkpoint, data, 0644, false); err != nil {
+		s.node.errorHandler(err)
+		return
+	}
+	s.saved = cp
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package rua
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+type notifyWatcher struct {
+	file  *os.File
+	name  string // only wake for events of this name if not empty
+	wakeC chan bool
+}
+
+// Watch the file with inotify. If `followName` is true, watch the directory of the file instead,
+// so creation, renaming and deletion of the name are also reported.
+func newNotifyWatcher(path string, followName bool) (tailWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF)
+	name := ""
+	if followName {
+		path, name = filepath.Dir(path), filepath.Base(path)
+		mask |= syscall.IN_CREATE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE
+	}
+	if _, err := syscall.InotifyAddWatch(fd, path, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	w := &notifyWatcher{
+		// a non-blocking fd is managed by the runtime poller, so closing the file unblocks reading
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		name:  name,
+		wakeC: make(chan bool, 1),
+	}
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := w.file.Read(buf)
+			if err != nil {
+				return
+			}
+			if w.match(buf[:n]) {
+				select {
+				case w.wakeC <- true:
+				default:
+				}
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Return true if any event is about the watched name.
+func (w *notifyWatcher) match(events []byte) bool {
+	if len(w.name) == 0 {
+		return true
+	}
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(events); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&events[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		end := start + int(event.Len)
+		if end > len(events) {
+			return true
+		}
+		name := string(bytes.TrimRight(events[start:end], "\x00"))
+		// events without a name are about the directory itself
+		if len(name) == 0 || name == w.name {
+			return true
+		}
+		offset = end
+	}
+	return false
+}
+
+func (w *notifyWatcher) wake() <-chan bool {
+	return w.wakeC
+}
+
+func (w *notifyWatcher) close() error {
+	return w.file.Close()
+}
+
+// Return the inode of the file, or 0 if unknown.
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package rua
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestTailNodeWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.log")
+	ioutil.WriteFile(path, nil, 0644)
+
+	tests := []struct {
+		name   string
+		node   *TailNode
+		notify bool
+	}{
+		{"inotify", NewTailNode(path), true},
+		{"inotify on the directory", NewTailNode(path).FollowName(true), true},
+		{"polling", NewTailNode(path).Polling(true), false},
+		{"fallback to polling", NewTailNode(filepath.Join(path, "missing")), false},
+	}
+
+	for _, tt := range tests {
+		w := tt.node.newWatcher()
+		if _, ok := w.(*notifyWatcher); ok != tt.notify {
+			t.Errorf("%s: want inotify %v, got %T", tt.name, tt.notify, w)
+		}
+		w.close()
+	}
+}
+
+func TestTailNodeWakesByInotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.log")
+	ioutil.WriteFile(path, nil, 0644)
+
+	// polling would take a minute
+	lines, h := startTail(t, NewTailNode(path).CheckIntervalMs(60000))
+	defer stopTail(h)
+	appendFile(t, path, "a\n")
+	expectLines(t, lines, "a")
+}
+
+// Encode events as read from inotify, into a buffer as large as the one the watcher reads into.
+func inotifyEvents(names ...string) []byte {
+	buf := make([]byte, 0, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for _, name := range names {
+		event := syscall.InotifyEvent{Len: uint32(len(name))}
+		header := (*[syscall.SizeofInotifyEvent]byte)(unsafe.Pointer(&event))
+		buf = append(append(buf, header[:]...), name...)
+	}
+	return buf
+}
+
+func TestNotifyWatcherMatch(t *testing.T) {
+	w := &notifyWatcher{name: "f.log"}
+	tests := []struct {
+		name   string
+		events []byte
+		want   bool
+	}{
+		{"the name", inotifyEvents("f.log\x00\x00\x00"), true},
+		{"another name", inotifyEvents("g.log\x00\x00\x00"), false},
+		{"the directory", inotifyEvents(""), true},
+		{"the name after another name", inotifyEvents("g.log\x00\x00\x00", "f.log\x00\x00\x00"), true},
+		{"a prefix of the name", inotifyEvents("f.lo\x00\x00\x00\x00"), false},
+	}
+
+	for _, tt := range tests {
+		if got := w.match(tt.events); got != tt.want {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	// without a name every event matches
+	if !(&notifyWatcher{}).match(inotifyEvents("g.log\x00\x00\x00")) {
+		t.Error("want a match without a name")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package rua
+
+import (
+	"errors"
+	"os"
+)
+
+// inotify is only available on linux.
+func newNotifyWatcher(path string, followName bool) (tailWatcher, error) {
+	return nil, errors.New("inotify is not supported on this platform")
+}
+
+// Inodes are only checked on linux.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,198 @@
+package rua
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Start the node and return its lines.
+func startTail(t *testing.T, n *TailNode) (chan string, *StopOnlyHandle) {
+	lines := make(chan string, 64)
+	h, err := n.OnNewLine(func(b []byte) { lines <- string(b) }).Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines, h
+}
+
+func expectLines(t *testing.T, lines chan string, want ...string) {
+	for _, w := range want {
+		select {
+		case got := <-lines:
+			if got != w {
+				t.Fatalf("want %q, got %q", w, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %q", w)
+		}
+	}
+}
+
+func stopTail(h *StopOnlyHandle) {
+	done := make(chan bool)
+	h.StopThen(func(error) { close(done) })
+	<-done
+}
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(data)
+	f.Close()
+}
+
+func TestLastLinesOffset(t *testing.T) {
+	tests := []struct {
+		content string
+		count   int
+		want    int64
+	}{
+		{"1\n2\n3\n", 0, 6},
+		{"1\n2\n3\n", 1, 4},
+		{"1\n2\n3\n", 2, 2},
+		{"1\n2\n3\n", 3, 0},
+		{"1\n2\n3\n", 10, 0},
+		{"1\n2\n3", 1, 4}, // an incomplete last line is counted
+		{"1\n2\n3", 2, 2},
+		{"1\n\n3\n", 2, 2},
+		{"", 1, 0},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, "f")
+		ioutil.WriteFile(path, []byte(tt.content), 0644)
+		f, _ := os.Open(path)
+		got, err := lastLinesOffset(f, int64(len(tt.content)), tt.count)
+		f.Close()
+		if err != nil || got != tt.want {
+			t.Errorf("%d: %q last %d lines: want %d, got %d, %v", i, tt.content, tt.count, tt.want, got, err)
+		}
+	}
+}
+
+func TestTailNodeStartPositions(t *testing.T) {
+	tests := []struct {
+		name string
+		node func(*TailNode) *TailNode
+		want []string
+	}{
+		{"end", func(n *TailNode) *TailNode { return n }, []string{"x"}},
+		{"beginning", func(n *TailNode) *TailNode { return n.FromBeginning() }, []string{"1", "2", "3", "x"}},
+		{"offset", func(n *TailNode) *TailNode { return n.FromOffset(2) }, []string{"2", "3", "x"}},
+		{"offset beyond the end", func(n *TailNode) *TailNode { return n.FromOffset(100) }, []string{"x"}},
+		{"last lines", func(n *TailNode) *TailNode { return n.FromLastLines(2) }, []string{"2", "3", "x"}},
+		{"more lines than the file", func(n *TailNode) *TailNode { return n.FromLastLines(10) }, []string{"1", "2", "3", "x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.log")
+			ioutil.WriteFile(path, []byte("1\n2\n3\n"), 0644)
+			lines, h := startTail(t, tt.node(NewTailNode(path)))
+			defer stopTail(h)
+
+			appendFile(t, path, "x\n")
+			expectLines(t, lines, tt.want...)
+		})
+	}
+}
+
+func TestTailNodePartialLine(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "f.log")
+		ioutil.WriteFile(path, nil, 0644)
+		lines, h := startTail(t, NewTailNode(path).Polling(polling))
+
+		appendFile(t, path, "a\r\nb")
+		expectLines(t, lines, "a")
+		appendFile(t, path, "c\n\n")
+		expectLines(t, lines, "bc", "")
+		stopTail(h)
+	}
+}
+
+func TestTailNodeFollowName(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "f.log")
+
+		// the file doesn't exist yet
+		lines, h := startTail(t, NewTailNode(path).FollowName(true).Polling(polling))
+		appendFile(t, path, "a\n")
+		expectLines(t, lines, "a")
+
+		// rename, the incomplete last line of the old file is drained
+		appendFile(t, path, "b")
+		os.Rename(path, path+".1")
+		appendFile(t, path, "cccccc\n")
+		expectLines(t, lines, "b", "cccccc")
+
+		// truncate
+		os.Truncate(path, 0)
+		appendFile(t, path, "d\n")
+		expectLines(t, lines, "d")
+
+		// delete and create again
+		os.Remove(path)
+		appendFile(t, path, "e\n")
+		expectLines(t, lines, "e")
+		stopTail(h)
+	}
+}
+
+func TestTailNodeMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.log")
+	if _, err := NewTailNode(path).OnNewLine(func([]byte) {}).Go(); err == nil {
+		t.Fatal("want error when the file doesn't exist and the name isn't followed")
+	}
+}
+
+func TestTailNodeCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.log")
+	cp := filepath.Join(dir, "f.checkpoint")
+	ioutil.WriteFile(path, []byte("a\nb\n"), 0644)
+
+	lines, h := startTail(t, NewTailNode(path).FromBeginning().Checkpoint(cp))
+	expectLines(t, lines, "a", "b")
+	stopTail(h)
+
+	// resume after the last delivered line
+	appendFile(t, path, "c\n")
+	lines, h = startTail(t, NewTailNode(path).FromBeginning().Checkpoint(cp))
+	expectLines(t, lines, "c")
+	stopTail(h)
+
+	// truncated after the checkpoint, start from the beginning
+	ioutil.WriteFile(path, []byte("d\n"), 0644)
+	lines, h = startTail(t, NewTailNode(path).Checkpoint(cp))
+	expectLines(t, lines, "d")
+	stopTail(h)
+}
+
+func TestTailNodeCheckpointInodeChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.log")
+	cp := filepath.Join(dir, "f.checkpoint")
+	ioutil.WriteFile(path, []byte("a\nb\n"), 0644)
+	if info, _ := os.Stat(path); fileInode(info) == 0 {
+		t.Skip("inodes are not supported on this platform")
+	}
+
+	lines, h := startTail(t, NewTailNode(path).FromBeginning().Checkpoint(cp))
+	expectLines(t, lines, "a", "b")
+	stopTail(h)
+
+	// replace the file with a longer one, the old offset is meaningless
+	ioutil.WriteFile(path+".new", []byte("xxxxxxxx\ny\n"), 0644)
+	os.Rename(path+".new", path)
+	lines, h = startTail(t, NewTailNode(path).Checkpoint(cp))
+	expectLines(t, lines, "xxxxxxxx", "y")
+	stopTail(h)
+}
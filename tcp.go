@@ -1,15 +1,43 @@
 package rua
 
 import (
-	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
 type TcpListener struct {
 	addr            string
 	peerHandler     func(*TcpNode)
 	peerWriteBuffer uint
+	peerCodec       Codec
+	peerMaxFrame    int
+	certFile        string
+	keyFile         string
+	tlsConfig       *tls.Config
+	clientCAFile    string
+	clientAuth      tls.ClientAuthType
+	handshakeMs     uint64
+	guardian        func(net.Conn) bool
+	maxConns        int
+	maxConnsPerIp   int
+	acceptRate      float64
+	acceptBurst     int
+	allowCidrs      []string
+	denyCidrs       []string
+	rejectHandler   func(net.Conn, error)
+	peerReadMs      uint64
+	peerWriteMs     uint64
+	peerHeartbeat   *Heartbeat
+	proxyMode       ProxyProtocolMode
+	proxyTrusted    []string
+	stopPeers       bool
+	listener        net.Listener
+	peers           *peerSet
 	handle          *StopOnlyHandle
 	stopRx          chan *StopPayload
 }
@@ -22,7 +50,32 @@ func NewTcpListener(addr string) *TcpListener {
 		addr:            addr,
 		peerHandler:     nil,
 		peerWriteBuffer: 16,
+		peerCodec:       LineCodec(),
+		peerMaxFrame:    0,
+		certFile:        "",
+		keyFile:         "",
+		tlsConfig:       nil,
+		clientCAFile:    "",
+		clientAuth:      tls.NoClientCert,
+		handshakeMs:     10000,
+		guardian:        nil,
+		maxConns:        0,
+		maxConnsPerIp:   0,
+		acceptRate:      0,
+		acceptBurst:     0,
+		allowCidrs:      []string{},
+		denyCidrs:       []string{},
+		rejectHandler:   func(net.Conn, error) {},
+		peerReadMs:      0,
+		peerWriteMs:     0,
+		peerHeartbeat:   nil,
+		proxyMode:       ProxyProtocolOff,
+		proxyTrusted:    []string{},
+		stopPeers:       false,
+		listener:        nil,
+		peers:           newPeerSet(),
 		handle:          handle,
+		stopRx:          stopChan,
 	}
 }
 
@@ -31,39 +84,312 @@ func (l *TcpListener) PeerWriteBuffer(buffer uint) *TcpListener {
 	return l
 }
 
+// Set the codec of new peers. Default is `LineCodec`.
+func (l *TcpListener) PeerCodec(c Codec) *TcpListener {
+	l.peerCodec = c
+	return l
+}
+
+// Set the max frame size of new peers. Default is 0 which means no limit.
+func (l *TcpListener) PeerMaxFrameSize(size int) *TcpListener {
+	l.peerMaxFrame = size
+	return l
+}
+
+// Set the read idle timeout of new peers. Default is 0 which means no timeout.
+func (l *TcpListener) PeerReadTimeoutMs(ms uint64) *TcpListener {
+	l.peerReadMs = ms
+	return l
+}
+
+// Set the write timeout of new peers. Default is 0 which means no timeout.
+func (l *TcpListener) PeerWriteTimeoutMs(ms uint64) *TcpListener {
+	l.peerWriteMs = ms
+	return l
+}
+
+// Enable heartbeat for new peers. Default is nil which means no heartbeat.
+func (l *TcpListener) PeerHeartbeat(h *Heartbeat) *TcpListener {
+	l.peerHeartbeat = h
+	return l
+}
+
+// Parse the PROXY protocol v1/v2 header so peers report the real client address. Default is `ProxyProtocolOff`.
+// `ProxyTrustedCidr` is required, otherwise any client could forge its address.
+// The header should arrive within the handshake timeout. In optional mode a client which sends nothing
+// is admitted without a header when the timeout expires.
+// Rejected connections are reported to `OnReject` with `ErrProxyHeaderMissing`, `ErrProxyUntrusted` or a parse error.
+func (l *TcpListener) ProxyProtocol(mode ProxyProtocolMode) *TcpListener {
+	l.proxyMode = mode
+	return l
+}
+
+// Only parse PROXY protocol headers from these networks, e.g. the load balancer.
+// In strict mode connections from other sources are rejected, in optional mode they keep the socket address.
+func (l *TcpListener) ProxyTrustedCidr(cidrs ...string) *TcpListener {
+	l.proxyTrusted = append(l.proxyTrusted, cidrs...)
+	return l
+}
+
+// Enable TLS with the certificate and key files.
+func (l *TcpListener) TLS(certFile, keyFile string) *TcpListener {
+	l.certFile = certFile
+	l.keyFile = keyFile
+	return l
+}
+
+// Enable TLS with the config. Certificate files set by `TLS` will be appended to the config.
+func (l *TcpListener) TLSConfig(config *tls.Config) *TcpListener {
+	l.tlsConfig = config
+	return l
+}
+
+// Verify client certificates with the CA file.
+// If `required` is false, clients without certificates are also accepted.
+func (l *TcpListener) ClientCA(caFile string, required bool) *TcpListener {
+	l.clientCAFile = caFile
+	if required {
+		l.clientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		l.clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return l
+}
+
+// Connections which don't finish the TLS handshake or send the PROXY protocol header in time will be closed.
+// Default is 10000.
+func (l *TcpListener) HandshakeTimeoutMs(ms uint64) *TcpListener {
+	l.handshakeMs = ms
+	return l
+}
+
+// Connections will be closed if the guardian returns false.
+func (l *TcpListener) Guardian(g func(net.Conn) bool) *TcpListener {
+	l.guardian = g
+	return l
+}
+
+// Max concurrent connections. Default is 0 which means no limit.
+func (l *TcpListener) MaxConnections(n int) *TcpListener {
+	l.maxConns = n
+	return l
+}
+
+// Max concurrent connections from the same ip. Default is 0 which means no limit.
+func (l *TcpListener) MaxConnectionsPerIp(n int) *TcpListener {
+	l.maxConnsPerIp = n
+	return l
+}
+
+// Accept at most `perSecond` connections per second on average, and at most `burst` connections at once.
+// A burst less than 1 is treated as 1. Default is 0 which means no limit.
+func (l *TcpListener) AcceptRate(perSecond float64, burst int) *TcpListener {
+	l.acceptRate = perSecond
+	l.acceptBurst = burst
+	return l
+}
+
+// Only accept connections from these networks, e.g. `10.0.0.0/8` or `127.0.0.1`.
+func (l *TcpListener) AllowCidr(cidrs ...string) *TcpListener {
+	l.allowCidrs = append(l.allowCidrs, cidrs...)
+	return l
+}
+
+// Reject connections from these networks, this takes precedence over `AllowCidr`.
+func (l *TcpListener) DenyCidr(cidrs ...string) *TcpListener {
+	l.denyCidrs = append(l.denyCidrs, cidrs...)
+	return l
+}
+
+// The handler will be called before a rejected connection is closed.
+// The reason is one of `ErrIpDenied`, `ErrAcceptRateExceeded`, `ErrMaxConnections`,
+// `ErrMaxConnectionsPerIp` and `ErrRejectedByGuardian`.
+func (l *TcpListener) OnReject(f func(conn net.Conn, reason error)) *TcpListener {
+	l.rejectHandler = f
+	return l
+}
+
 func (l *TcpListener) OnNewPeer(f func(*TcpNode)) *TcpListener {
 	l.peerHandler = f
 	return l
 }
 
+// Stop all accepted peers when the listener is stopped. Default is false.
+// The stop callback will get the first error of stopping peers.
+func (l *TcpListener) StopPeers(enable bool) *TcpListener {
+	l.stopPeers = enable
+	return l
+}
+
 func (l *TcpListener) Handle() *StopOnlyHandle {
 	return l.handle
 }
 
-// Return error if missing `peerHandler`。
+// Return the listening address, or nil if the listener is not started.
+// This is useful when listening on port 0.
+func (l *TcpListener) Addr() net.Addr {
+	if l.listener == nil {
+		return nil
+	}
+	return l.listener.Addr()
+}
+
+// Return the number of accepted peers which are not closed yet.
+func (l *TcpListener) PeerCount() int {
+	return l.peers.count()
+}
+
+// Return nil if TLS is not enabled.
+func (l *TcpListener) buildTLSConfig() (*tls.Config, error) {
+	if l.tlsConfig == nil && len(l.certFile) == 0 && len(l.clientCAFile) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if l.tlsConfig != nil {
+		config = l.tlsConfig.Clone()
+	}
+	if len(l.certFile) != 0 && len(l.keyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, errors.New("missing certificate")
+	}
+	if len(l.clientCAFile) != 0 {
+		pool, err := loadCertPool(l.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = l.clientAuth
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return pool, nil
+}
+
+func (l *TcpListener) buildAdmission() (*admission, error) {
+	allow, err := parseCidrs(l.allowCidrs)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCidrs(l.denyCidrs)
+	if err != nil {
+		return nil, err
+	}
+	// at least one connection can be accepted at once
+	burst := float64(l.acceptBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &admission{
+		allow:      allow,
+		deny:       deny,
+		maxConns:   l.maxConns,
+		maxConnsIp: l.maxConnsPerIp,
+		ratePerSec: l.acceptRate,
+		burst:      burst,
+		tokens:     burst,
+		lastRefill: time.Now(),
+		guardian:   l.guardian,
+		connsPerIp: make(map[string]int),
+		lock:       &sync.Mutex{},
+	}, nil
+}
+
+// `release` is called when the peer is closed.
+func (l *TcpListener) newPeer(conn net.Conn, release func()) *TcpNode {
+	node := NewTcpNode(conn, l.peerWriteBuffer).
+		Codec(l.peerCodec).
+		MaxFrameSize(l.peerMaxFrame).
+		ReadTimeoutMs(l.peerReadMs).
+		WriteTimeoutMs(l.peerWriteMs).
+		Heartbeat(l.peerHeartbeat)
+
+	l.peers.add(node.stream)
+	untrack := node.stream.closeHandler
+	node.stream.closeHandler = func() {
+		release()
+		untrack()
+	}
+	return node
+}
+
+// Return error if missing `peerHandler`, or TLS config or cidrs are invalid.
 func (l *TcpListener) Go() (*StopOnlyHandle, error) {
 	if l.peerHandler == nil {
 		return nil, errors.New("missing peerHandler")
 	}
 
+	tlsConfig, err := l.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	admission, err := l.buildAdmission()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyTrusted, err := parseCidrs(l.proxyTrusted)
+	if err != nil {
+		return nil, err
+	}
+	if l.proxyMode != ProxyProtocolOff && len(proxyTrusted) == 0 {
+		return nil, errors.New("missing proxyTrustedCidr")
+	}
+
 	listener, err := net.Listen("tcp", l.addr)
 	if err != nil {
 		return nil, err
 	}
+	l.listener = listener
+	stopped := make(chan bool)
 
+	// stopper thread
+	go func() {
+		payload := <-l.stopRx
+		close(stopped)
+		// this will break the accept loop
+		err := listener.Close()
+		if l.stopPeers {
+			if peerErr := l.peers.stopAll(); err == nil {
+				err = peerErr
+			}
+		}
+		payload.Callback(err)
+	}()
+
+	// accept thread
 	go func() {
 		loop := true
 		for loop {
 			select {
-			case payload := <-l.stopRx:
-				payload.Callback(nil)
+			case <-stopped:
 				loop = false
 			default:
 				conn, err := listener.Accept()
 				if err != nil {
 					loop = false
+				} else if tlsConfig == nil && l.proxyMode == ProxyProtocolOff {
+					l.serveConn(conn, nil, admission, proxyTrusted, stopped)
 				} else {
-					l.peerHandler(NewTcpNode(conn, l.peerWriteBuffer))
+					// handshake in another goroutine to avoid blocking the listener
+					go l.serveConn(conn, tlsConfig, admission, proxyTrusted, stopped)
 				}
 			}
 		}
@@ -72,92 +398,133 @@ func (l *TcpListener) Go() (*StopOnlyHandle, error) {
 	return l.handle, nil
 }
 
+// Read the PROXY protocol header, check the admission, do the TLS handshake, then create the peer.
+func (l *TcpListener) serveConn(conn net.Conn, tlsConfig *tls.Config, admission *admission, proxyTrusted []*net.IPNet, stopped chan bool) {
+	if l.proxyMode != ProxyProtocolOff {
+		proxied, err := readProxyHeader(conn, l.proxyMode, proxyTrusted, l.handshakeMs)
+		if err != nil {
+			l.rejectHandler(conn, err)
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+
+	if reason := admission.admit(conn); reason != nil {
+		l.rejectHandler(conn, reason)
+		conn.Close()
+		return
+	}
+	// keep the original connection so `TcpNode.Conn` can be type asserted
+	release := admission.releaser(conn)
+
+	if tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		if l.handshakeMs != 0 {
+			tlsConn.SetDeadline(time.Now().Add(time.Duration(l.handshakeMs) * time.Millisecond))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			release()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	select {
+	case <-stopped:
+		conn.Close()
+		release()
+	default:
+		l.peerHandler(l.newPeer(conn, release))
+	}
+}
+
 type TcpNode struct {
-	handle       *Handle
-	conn         net.Conn
-	inputHandler func([]byte)
-	rx           chan *WritePayload
-	stopRx       chan *StopPayload
+	conn   net.Conn
+	stream *StreamNode
 }
 
 func NewTcpNode(conn net.Conn, buffer uint) *TcpNode {
-	msgChan := make(chan *WritePayload, buffer)
-	stopChan := make(chan *StopPayload)
-
-	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
 	return &TcpNode{
-		handle:       handle,
-		conn:         conn,
-		inputHandler: func(b []byte) {},
-		rx:           msgChan,
-		stopRx:       stopChan,
+		conn:   conn,
+		stream: NewReadWriteCloserNode(conn, buffer),
 	}
 }
 
+// Set the framing codec. Default is `LineCodec`.
+func (n *TcpNode) Codec(c Codec) *TcpNode {
+	n.stream.Codec(c)
+	return n
+}
+
+// Frames larger than the size will be rejected and the node will stop reading. Default is 0 which means no limit.
+func (n *TcpNode) MaxFrameSize(size int) *TcpNode {
+	n.stream.MaxFrameSize(size)
+	return n
+}
+
+// The node will be stopped if nothing is received during the timeout. Default is 0 which means no timeout.
+func (n *TcpNode) ReadTimeoutMs(ms uint64) *TcpNode {
+	n.stream.ReadTimeoutMs(ms)
+	return n
+}
+
+// The node will be stopped if a write can't finish during the timeout. Default is 0 which means no timeout.
+func (n *TcpNode) WriteTimeoutMs(ms uint64) *TcpNode {
+	n.stream.WriteTimeoutMs(ms)
+	return n
+}
+
+// Default is nil which means no heartbeat.
+func (n *TcpNode) Heartbeat(h *Heartbeat) *TcpNode {
+	n.stream.Heartbeat(h)
+	return n
+}
+
+// Queued writes are coalesced into one batch until the batch reaches the size. Default is 65536, 0 means no limit.
+func (n *TcpNode) MaxBatchSize(size int) *TcpNode {
+	n.stream.MaxBatchSize(size)
+	return n
+}
+
+// Wait at most `ms` for more writes before flushing a batch. Default is 0 which means no waiting.
+func (n *TcpNode) FlushLatencyMs(ms uint64) *TcpNode {
+	n.stream.FlushLatencyMs(ms)
+	return n
+}
+
 func (n *TcpNode) OnInput(f func([]byte)) *TcpNode {
-	n.inputHandler = f
+	n.stream.OnInput(f)
 	return n
 }
 
 func (n *TcpNode) Handle() *Handle {
-	return n.handle
+	return n.stream.Handle()
 }
 
 func (n *TcpNode) Conn() net.Conn {
 	return n.conn
 }
 
-func (n *TcpNode) Go() *Handle {
-	readerStopper := make(chan bool)
-	writerStopper := make(chan bool)
-
-	// stopper thread
-	go func() {
-		payload := <-n.stopRx
-		readerStopper <- true
-		writerStopper <- true
-		payload.Callback(nil)
-	}()
-
-	// reader thread
-	go func() {
-		reader := bufio.NewReader(n.conn)
-		loop := true
-		for loop {
-			select {
-			case <-readerStopper:
-				loop = false
-			default:
-				line, err := reader.ReadString('\n')
-				if len(line) == 0 || err != nil {
-					break
-				}
-				line = line[:len(line)-1] // remove \n
-				if line[len(line)-1] == '\r' {
-					line = line[:len(line)-1] // remove \r
-				}
-				n.inputHandler([]byte(line))
-			}
-		}
-		writerStopper <- true
-	}()
+// Return false if the connection is not a TLS connection.
+func (n *TcpNode) TLSConnectionState() (tls.ConnectionState, bool) {
+	if tlsConn, ok := n.conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
 
-	// writer thread
-	go func() {
-		loop := true
-		for loop {
-			select {
-			case <-writerStopper:
-				loop = false
-			case payload := <-n.rx:
-				_, err := n.conn.Write(append(payload.Data, '\n'))
-				payload.Callback(err)
-				if err != nil {
-					loop = false
-				}
-			}
-		}
-	}()
+// Return the verified certificate chains of the peer, or nil if the peer is not verified.
+func (n *TcpNode) VerifiedChains() [][]*x509.Certificate {
+	state, ok := n.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.VerifiedChains
+}
 
-	return n.handle
+func (n *TcpNode) Go() *Handle {
+	return n.stream.Go()
 }
@@ -0,0 +1,266 @@
+package rua
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	tls     tls.Certificate
+	certPem string // file paths
+	keyPem  string
+}
+
+// Create a certificate signed by `parent`, or a self-signed CA if `parent` is nil.
+func newTestCert(t *testing.T, dir, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	c := &testCert{
+		cert:    cert,
+		key:     key,
+		tls:     tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		certPem: filepath.Join(dir, name+".pem"),
+		keyPem:  filepath.Join(dir, name+"-key.pem"),
+	}
+	ioutil.WriteFile(c.certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(c.keyPem, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+func TestTcpListenerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, 0)
+	server := newTestCert(t, dir, "server", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, dir, "client", ca, x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, dir, "other", nil, 0)
+	stranger := newTestCert(t, dir, "stranger", other, x509.ExtKeyUsageClientAuth)
+
+	peers := make(chan string, 1)
+	l := NewTcpListener("127.0.0.1:0").
+		TLS(server.certPem, server.keyPem).
+		ClientCA(ca.certPem, true).
+		HandshakeTimeoutMs(1000).
+		StopPeers(true).
+		OnNewPeer(func(peer *TcpNode) {
+			chains := peer.VerifiedChains()
+			if len(chains) == 0 {
+				peers <- ""
+				return
+			}
+			peers <- chains[0][0].Subject.CommonName
+			// echo
+			peer.OnInput(func(b []byte) { peer.Handle().Write(b) }).Go()
+		})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs []tls.Certificate) (string, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("hello\n")); err != nil {
+			return "", err
+		}
+		// with TLS 1.3 a rejected client certificate is reported by the first read
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	t.Run("verified client", func(t *testing.T) {
+		line, err := dial([]tls.Certificate{client.tls})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "hello\n" {
+			t.Fatalf("want echo, got %q", line)
+		}
+		if name := <-peers; name != "client" {
+			t.Fatalf("want verified client, got %q", name)
+		}
+	})
+
+	t.Run("missing client certificate", func(t *testing.T) {
+		if _, err := dial(nil); err == nil {
+			t.Fatal("want error")
+		}
+	})
+
+	t.Run("unknown client CA", func(t *testing.T) {
+		if _, err := dial([]tls.Certificate{stranger.tls}); err == nil {
+			t.Fatal("want error")
+		}
+	})
+
+	if n := len(peers); n != 0 {
+		t.Fatalf("want rejected clients not to become peers, got %d", n)
+	}
+}
+
+func TestTcpListenerConfig(t *testing.T) {
+	noop := func(*TcpNode) {}
+	tests := []struct {
+		name     string
+		listener *TcpListener
+	}{
+		{"missing peer handler", NewTcpListener("127.0.0.1:0")},
+		{"missing certificate", NewTcpListener("127.0.0.1:0").ClientCA("ca.pem", true).OnNewPeer(noop)},
+		{"missing certificate file", NewTcpListener("127.0.0.1:0").TLS("missing.pem", "missing-key.pem").OnNewPeer(noop)},
+		{"invalid cidr", NewTcpListener("127.0.0.1:0").AllowCidr("10.0.0.0/33").OnNewPeer(noop)},
+		{"proxy protocol without trusted networks", NewTcpListener("127.0.0.1:0").ProxyProtocol(ProxyProtocolOptional).OnNewPeer(noop)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.listener.Go(); err == nil {
+				t.Fatal("want error")
+			}
+			if tt.listener.Addr() != nil {
+				t.Fatal("want nil address when not started")
+			}
+		})
+	}
+}
+
+// Wait until `f` returns true, or fail after a second.
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTcpPeerIdleTimeoutLeavesBroadcaster(t *testing.T) {
+	bc := NewBroadcaster()
+	added := make(chan uint, 1)
+	l := NewTcpListener("127.0.0.1:0").
+		PeerReadTimeoutMs(100).
+		OnNewPeer(func(peer *TcpNode) {
+			bc.AddTargetThen(peer.Go(), func(id uint) { added <- id })
+		})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	// an idle client
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-added
+	waitFor(t, "the peer to time out", func() bool { return l.PeerCount() == 0 })
+
+	result := make(chan error, 1)
+	bc.WriteThen([]byte("hello"), func(err error) { result <- err })
+	select {
+	case err := <-result:
+		if err != ErrNodeStopped {
+			t.Fatalf("want ErrNodeStopped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write to a stopped peer never called back")
+	}
+
+	waitFor(t, "the peer to be removed", func() bool {
+		bc.lock.Lock()
+		defer bc.lock.Unlock()
+		return len(bc.targets) == 0
+	})
+}
+
+func TestTcpListenerMaxConnections(t *testing.T) {
+	peers := make(chan *TcpNode, 2)
+	rejected := make(chan error, 2)
+	l := NewTcpListener("127.0.0.1:0").
+		MaxConnections(1).
+		OnReject(func(_ net.Conn, reason error) { rejected <- reason }).
+		OnNewPeer(func(peer *TcpNode) {
+			peer.Go()
+			peers <- peer
+		})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	first, _ := net.Dial("tcp", l.Addr().String())
+	defer first.Close()
+	peer := <-peers
+	if _, ok := peer.Conn().(*net.TCPConn); !ok {
+		t.Fatalf("want *net.TCPConn, got %T", peer.Conn())
+	}
+
+	second, _ := net.Dial("tcp", l.Addr().String())
+	defer second.Close()
+	if reason := <-rejected; reason != ErrMaxConnections {
+		t.Fatalf("want ErrMaxConnections, got %v", reason)
+	}
+
+	// the slot is released when the peer is closed
+	peer.Handle().Stop()
+	waitFor(t, "the peer to be closed", func() bool { return l.PeerCount() == 0 })
+	third, _ := net.Dial("tcp", l.Addr().String())
+	defer third.Close()
+	select {
+	case <-peers:
+	case reason := <-rejected:
+		t.Fatalf("want the connection admitted, got %v", reason)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
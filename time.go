@@ -2,25 +2,126 @@ package rua
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
+type OverrunPolicy int
+
+const (
+	// Drop the missed ticks and wait for the next scheduled time.
+	OverrunSkip OverrunPolicy = iota
+	// Run the missed ticks immediately, at most `maxBurst` ticks in a row, the rest will be skipped.
+	OverrunCatchUp
+	// Shift the schedule, the next tick will be one interval after the overrun tick finished.
+	OverrunStretch
+)
+
+type TickInfo struct {
+	Tick      uint64
+	Scheduled time.Time     // when the tick should happen
+	Time      time.Time     // when the tick actually happens
+	Delta     time.Duration // actual time since the last tick
+}
+
+type TickerStats struct {
+	Ticks      uint64
+	Skipped    uint64
+	MinJitter  time.Duration // jitter is the delay between the scheduled time and the actual time
+	MaxJitter  time.Duration
+	MeanJitter time.Duration
+}
+
+type tickerOp int
+
+const (
+	tickerPause tickerOp = iota
+	tickerResume
+	tickerSetInterval
+	tickerTickNow
+)
+
+type tickerCtrlPayload struct {
+	op         tickerOp
+	intervalMs uint64
+	callback   func(error)
+}
+
+type TickerHandle struct {
+	StopOnlyHandle
+	ctrlTx chan *tickerCtrlPayload
+}
+
+func (h *TickerHandle) send(payload *tickerCtrlPayload) {
+	ctrlTx := h.ctrlTx
+	go func() {
+		ctrlTx <- payload
+	}()
+}
+
+func (h *TickerHandle) Pause() {
+	h.PauseThen(func(error) {})
+}
+
+func (h *TickerHandle) PauseThen(callback func(error)) {
+	h.send(&tickerCtrlPayload{op: tickerPause, callback: callback})
+}
+
+// Resume a paused ticker, the next tick will happen after a full interval.
+func (h *TickerHandle) Resume() {
+	h.ResumeThen(func(error) {})
+}
+
+func (h *TickerHandle) ResumeThen(callback func(error)) {
+	h.send(&tickerCtrlPayload{op: tickerResume, callback: callback})
+}
+
+// Change the interval of a running ticker, the next tick will happen one new interval after the last tick.
+func (h *TickerHandle) SetIntervalMs(ms uint64) {
+	h.SetIntervalMsThen(ms, func(error) {})
+}
+
+func (h *TickerHandle) SetIntervalMsThen(ms uint64, callback func(error)) {
+	h.send(&tickerCtrlPayload{op: tickerSetInterval, intervalMs: ms, callback: callback})
+}
+
+// Trigger an extra tick immediately, even if the ticker is paused. The schedule is not changed.
+func (h *TickerHandle) TickNow() {
+	h.TickNowThen(func(error) {})
+}
+
+func (h *TickerHandle) TickNowThen(callback func(error)) {
+	h.send(&tickerCtrlPayload{op: tickerTickNow, callback: callback})
+}
+
 type Ticker struct {
-	tickHandler func(uint64)
-	intervalMs  uint64
-	stopRx      chan *StopPayload
-	handle      *StopOnlyHandle
+	tickHandler   func(uint64)
+	stepHandler   func(*TickInfo)
+	intervalMs    uint64
+	overrunPolicy OverrunPolicy
+	maxBurst      uint
+	stats         TickerStats
+	statsLock     *sync.Mutex
+	stopRx        chan *StopPayload
+	ctrlRx        chan *tickerCtrlPayload
+	handle        *TickerHandle
 }
 
 func NewTicker(intervalMs uint64) *Ticker {
 	stopChan := make(chan *StopPayload)
+	ctrlChan := make(chan *tickerCtrlPayload)
 
 	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
 	return &Ticker{
-		tickHandler: nil,
-		intervalMs:  intervalMs,
-		stopRx:      stopChan,
-		handle:      handle,
+		tickHandler:   nil,
+		stepHandler:   nil,
+		intervalMs:    intervalMs,
+		overrunPolicy: OverrunSkip,
+		maxBurst:      5,
+		statsLock:     &sync.Mutex{},
+		stopRx:        stopChan,
+		ctrlRx:        ctrlChan,
+		handle:        &TickerHandle{StopOnlyHandle: *handle, ctrlTx: ctrlChan},
 	}
 }
 
@@ -33,7 +134,18 @@ func (t *Ticker) IntervalMs(ms uint64) *Ticker {
 	return t
 }
 
-func (t *Ticker) Handle() *StopOnlyHandle {
+func (t *Ticker) OverrunPolicy(p OverrunPolicy) *Ticker {
+	t.overrunPolicy = p
+	return t
+}
+
+// Max ticks to run in a row when using `OverrunCatchUp`.
+func (t *Ticker) MaxBurst(n uint) *Ticker {
+	t.maxBurst = n
+	return t
+}
+
+func (t *Ticker) Handle() *TickerHandle {
 	return t.handle
 }
 
@@ -42,21 +154,142 @@ func (t *Ticker) OnTick(f func(uint64)) *Ticker {
 	return t
 }
 
-// Return error if missing `tickHandler`.
-func (t *Ticker) Go() (*StopOnlyHandle, error) {
-	if t.tickHandler == nil {
+// Like `OnTick`, but the handler will get the timing info of the tick.
+func (t *Ticker) OnStep(f func(*TickInfo)) *Ticker {
+	t.stepHandler = f
+	return t
+}
+
+func (t *Ticker) Stats() TickerStats {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	return t.stats
+}
+
+func (t *Ticker) recordTick(jitter time.Duration) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	if t.stats.Ticks == 0 || jitter < t.stats.MinJitter {
+		t.stats.MinJitter = jitter
+	}
+	if t.stats.Ticks == 0 || jitter > t.stats.MaxJitter {
+		t.stats.MaxJitter = jitter
+	}
+	t.stats.MeanJitter += (jitter - t.stats.MeanJitter) / time.Duration(t.stats.Ticks+1)
+	t.stats.Ticks += 1
+}
+
+func (t *Ticker) recordSkipped(n uint64) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	t.stats.Skipped += n
+}
+
+// Return error if missing both `tickHandler` and `stepHandler`, or `intervalMs` is 0.
+func (t *Ticker) Go() (*TickerHandle, error) {
+	if t.tickHandler == nil && t.stepHandler == nil {
 		return nil, errors.New("missing tickHandler")
 	}
+	if t.intervalMs == 0 {
+		return nil, errors.New("invalid intervalMs")
+	}
 
 	go func() {
 		var current uint64 = 0
-		ticker := time.NewTicker(time.Duration(t.intervalMs) * time.Millisecond)
+		var burst uint = 0
+		paused := false
+		interval := time.Duration(t.intervalMs) * time.Millisecond
+		last := time.Now()
+		// schedule is based on the start time to avoid drift
+		next := last.Add(interval)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+
+		tick := func(scheduled time.Time) {
+			now := time.Now()
+			t.recordTick(now.Sub(scheduled))
+			if t.tickHandler != nil {
+				t.tickHandler(current)
+			}
+			if t.stepHandler != nil {
+				t.stepHandler(&TickInfo{Tick: current, Scheduled: scheduled, Time: now, Delta: now.Sub(last)})
+			}
+			current += 1
+			last = now
+		}
+
+		stopTimer := func() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
 		loop := true
 		for loop {
 			select {
-			case <-ticker.C:
-				t.tickHandler(current)
-				current += 1
+			case <-timer.C:
+				tick(next)
+
+				// schedule next tick
+				next = next.Add(interval)
+				now := time.Now()
+				if !now.Before(next) {
+					// overrun
+					switch t.overrunPolicy {
+					case OverrunCatchUp:
+						if burst < t.maxBurst {
+							burst += 1
+						} else {
+							burst = 0
+							next = t.skip(next, now, interval)
+						}
+					case OverrunStretch:
+						next = now.Add(interval)
+					default:
+						next = t.skip(next, now, interval)
+					}
+				} else {
+					burst = 0
+				}
+				timer.Reset(next.Sub(now))
+			case payload := <-t.ctrlRx:
+				switch payload.op {
+				case tickerPause:
+					if !paused {
+						paused = true
+						stopTimer()
+					}
+					payload.callback(nil)
+				case tickerResume:
+					if paused {
+						paused = false
+						next = time.Now().Add(interval)
+						timer.Reset(interval)
+					}
+					payload.callback(nil)
+				case tickerSetInterval:
+					if payload.intervalMs == 0 {
+						payload.callback(errors.New("invalid intervalMs"))
+						break
+					}
+					interval = time.Duration(payload.intervalMs) * time.Millisecond
+					now := time.Now()
+					next = last.Add(interval)
+					if next.Before(now) {
+						next = now
+					}
+					if !paused {
+						stopTimer()
+						timer.Reset(next.Sub(now))
+					}
+					payload.callback(nil)
+				case tickerTickNow:
+					tick(time.Now())
+					payload.callback(nil)
+				}
 			case payload := <-t.stopRx:
 				payload.Callback(nil)
 				loop = false
@@ -66,3 +299,10 @@ func (t *Ticker) Go() (*StopOnlyHandle, error) {
 
 	return t.handle, nil
 }
+
+// Return the first scheduled time after `now`.
+func (t *Ticker) skip(next time.Time, now time.Time, interval time.Duration) time.Time {
+	missed := now.Sub(next)/interval + 1
+	t.recordSkipped(uint64(missed))
+	return next.Add(missed * interval)
+}
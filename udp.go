@@ -0,0 +1,504 @@
+package rua
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The max payload of an IPv4 UDP datagram.
+const udpMaxPayload = 65507
+
+// Reasons of dropped datagrams.
+var (
+	ErrDatagramTooLarge = errors.New("datagram too large")
+	ErrPeerBufferFull   = errors.New("peer read buffer is full")
+)
+
+type UdpListener struct {
+	addr            string
+	peerHandler     func(*UdpPeer)
+	dropHandler     func(*net.UDPAddr, error)
+	peerWriteBuffer uint
+	peerReadBuffer  uint
+	peerIdleMs      uint64
+	maxSize         int
+	conn            *net.UDPConn
+	peers           map[string]*UdpPeer
+	lock            *sync.Mutex
+	handle          *StopOnlyHandle
+	stopRx          chan *StopPayload
+}
+
+func NewUdpListener(addr string) *UdpListener {
+	stopChan := make(chan *StopPayload)
+	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
+
+	return &UdpListener{
+		addr:            addr,
+		peerHandler:     nil,
+		dropHandler:     func(*net.UDPAddr, error) {},
+		peerWriteBuffer: 16,
+		peerReadBuffer:  16,
+		peerIdleMs:      30000,
+		maxSize:         udpMaxPayload,
+		conn:            nil,
+		peers:           make(map[string]*UdpPeer),
+		lock:            &sync.Mutex{},
+		handle:          handle,
+		stopRx:          stopChan,
+	}
+}
+
+func (l *UdpListener) PeerWriteBuffer(buffer uint) *UdpListener {
+	l.peerWriteBuffer = buffer
+	return l
+}
+
+// Datagrams received when the buffer is full will be dropped. Default is 16.
+func (l *UdpListener) PeerReadBuffer(buffer uint) *UdpListener {
+	l.peerReadBuffer = buffer
+	return l
+}
+
+// Peers will be stopped if no datagram is received from them during the timeout.
+// Default is 30000, 0 means never.
+func (l *UdpListener) PeerIdleTimeoutMs(ms uint64) *UdpListener {
+	l.peerIdleMs = ms
+	return l
+}
+
+// Larger datagrams will be dropped when received and rejected when written. Default is 65507.
+func (l *UdpListener) MaxDatagramSize(size int) *UdpListener {
+	l.maxSize = size
+	return l
+}
+
+// Called with the first datagram from a new remote address.
+func (l *UdpListener) OnNewPeer(f func(*UdpPeer)) *UdpListener {
+	l.peerHandler = f
+	return l
+}
+
+// Called when a received datagram is dropped, with `ErrDatagramTooLarge` or `ErrPeerBufferFull`.
+func (l *UdpListener) OnDrop(f func(*net.UDPAddr, error)) *UdpListener {
+	l.dropHandler = f
+	return l
+}
+
+func (l *UdpListener) Handle() *StopOnlyHandle {
+	return l.handle
+}
+
+// Return the listening address, or nil if the listener is not started.
+func (l *UdpListener) Addr() net.Addr {
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.LocalAddr()
+}
+
+// Return the number of peers which are not stopped yet.
+func (l *UdpListener) PeerCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.peers)
+}
+
+// Return the peer of the address, create it if not exist.
+func (l *UdpListener) peer(addr *net.UDPAddr) (*UdpPeer, bool) {
+	key := addr.String()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if p, ok := l.peers[key]; ok {
+		return p, false
+	}
+
+	p := newUdpPeer(l.conn, addr, l.peerWriteBuffer, l.peerReadBuffer, l.maxSize)
+	p.closeHandler = func() {
+		l.lock.Lock()
+		if l.peers[key] == p {
+			delete(l.peers, key)
+		}
+		l.lock.Unlock()
+	}
+	l.peers[key] = p
+	return p, true
+}
+
+func (l *UdpListener) closePeers() {
+	l.lock.Lock()
+	peers := make([]*UdpPeer, 0, len(l.peers))
+	for _, p := range l.peers {
+		peers = append(peers, p)
+	}
+	l.lock.Unlock()
+
+	for _, p := range peers {
+		p.close()
+	}
+}
+
+func (l *UdpListener) expirePeers(now time.Time) {
+	deadline := now.Add(-time.Duration(l.peerIdleMs) * time.Millisecond).UnixNano()
+
+	l.lock.Lock()
+	expired := []*UdpPeer{}
+	for _, p := range l.peers {
+		if atomic.LoadInt64(&p.lastActive) < deadline {
+			expired = append(expired, p)
+		}
+	}
+	l.lock.Unlock()
+
+	for _, p := range expired {
+		p.close()
+	}
+}
+
+// Return error if missing `peerHandler`, or the address can't be listened.
+// Peers will be stopped when the listener is stopped since they share the same socket.
+func (l *UdpListener) Go() (*StopOnlyHandle, error) {
+	if l.peerHandler == nil {
+		return nil, errors.New("missing peerHandler")
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", l.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	stopped := make(chan bool)
+
+	// stopper thread
+	go func() {
+		payload := <-l.stopRx
+		close(stopped)
+		// this will break the read loop
+		err := conn.Close()
+		l.closePeers()
+		payload.Callback(err)
+	}()
+
+	// expiry thread
+	if l.peerIdleMs != 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(l.peerIdleMs) * time.Millisecond / 4)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopped:
+					return
+				case now := <-ticker.C:
+					l.expirePeers(now)
+				}
+			}
+		}()
+	}
+
+	// read thread
+	go func() {
+		// one more byte to detect oversized datagrams
+		buf := make([]byte, l.maxSize+1)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+			if n > l.maxSize {
+				l.dropHandler(addr, ErrDatagramTooLarge)
+				continue
+			}
+
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			p, created := l.peer(addr)
+			if created {
+				l.peerHandler(p)
+			}
+			if !p.deliver(data) {
+				l.dropHandler(addr, ErrPeerBufferFull)
+			}
+		}
+	}()
+
+	return l.handle, nil
+}
+
+// A virtual node of a remote address, created by `UdpListener`.
+type UdpPeer struct {
+	conn         *net.UDPConn
+	remote       *net.UDPAddr
+	maxSize      int
+	inputHandler func([]byte)
+	lastActive   int64 // unix nano
+	handle       *Handle
+	rx           chan *WritePayload
+	stopRx       chan *StopPayload
+	inputRx      chan []byte
+	stopped      chan bool
+	once         *sync.Once
+	closeHandler func()
+}
+
+func newUdpPeer(conn *net.UDPConn, remote *net.UDPAddr, writeBuffer, readBuffer uint, maxSize int) *UdpPeer {
+	msgChan := make(chan *WritePayload, writeBuffer)
+	stopChan := make(chan *StopPayload)
+	handle, _ := NewHandleBuilder().Tx(msgChan).StopTx(stopChan).Build()
+
+	return &UdpPeer{
+		conn:         conn,
+		remote:       remote,
+		maxSize:      maxSize,
+		inputHandler: func([]byte) {},
+		lastActive:   time.Now().UnixNano(),
+		handle:       handle,
+		rx:           msgChan,
+		stopRx:       stopChan,
+		inputRx:      make(chan []byte, readBuffer),
+		stopped:      make(chan bool),
+		once:         &sync.Once{},
+		closeHandler: func() {},
+	}
+}
+
+func (p *UdpPeer) OnInput(f func([]byte)) *UdpPeer {
+	p.inputHandler = f
+	return p
+}
+
+func (p *UdpPeer) Handle() *Handle {
+	return p.handle
+}
+
+func (p *UdpPeer) RemoteAddr() *net.UDPAddr {
+	return p.remote
+}
+
+// Queue the datagram without blocking, return false if the buffer is full.
+func (p *UdpPeer) deliver(data []byte) bool {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+	select {
+	case p.inputRx <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *UdpPeer) close() {
+	p.once.Do(func() {
+		close(p.stopped)
+		p.closeHandler()
+	})
+}
+
+func (p *UdpPeer) Go() *Handle {
+	// stopper thread
+	go func() {
+		select {
+		case payload := <-p.stopRx:
+			p.close()
+			payload.Callback(nil)
+		case <-p.stopped:
+		}
+	}()
+
+	// reader thread
+	go func() {
+		for {
+			select {
+			case <-p.stopped:
+				return
+			case data := <-p.inputRx:
+				p.inputHandler(data)
+			}
+		}
+	}()
+
+	// writer thread
+	go func() {
+		loop := true
+		for loop {
+			select {
+			case <-p.stopped:
+				loop = false
+			case payload := <-p.rx:
+				if len(payload.Data) > p.maxSize {
+					payload.Callback(ErrDatagramTooLarge)
+					break
+				}
+				_, err := p.conn.WriteToUDP(payload.Data, p.remote)
+				payload.Callback(err)
+			}
+		}
+
+		// the peer may be expired, fail later writes and answer later stop requests
+		for {
+			select {
+			case payload := <-p.rx:
+				payload.Callback(ErrNodeStopped)
+			case payload := <-p.stopRx:
+				payload.Callback(nil)
+			}
+		}
+	}()
+
+	return p.handle
+}
+
+type udpWritePayload struct {
+	data     []byte
+	addr     *net.UDPAddr
+	callback func(error)
+}
+
+type UdpHandle struct {
+	StopOnlyHandle
+	tx chan *udpWritePayload
+}
+
+// Send a datagram to the address.
+func (h *UdpHandle) WriteTo(data []byte, addr *net.UDPAddr) {
+	h.WriteToThen(data, addr, func(error) {})
+}
+
+func (h *UdpHandle) WriteToThen(data []byte, addr *net.UDPAddr, callback func(error)) {
+	tx := h.tx
+	go func() {
+		tx <- &udpWritePayload{data: data, addr: addr, callback: callback}
+	}()
+}
+
+// A connectionless node which can send datagrams to any address.
+type UdpNode struct {
+	addr         string
+	maxSize      int
+	inputHandler func([]byte, *net.UDPAddr)
+	conn         *net.UDPConn
+	handle       *UdpHandle
+	rx           chan *udpWritePayload
+	stopRx       chan *StopPayload
+}
+
+// Bind to the local address, e.g. `:0` to use a random port.
+func NewUdpNode(addr string, buffer uint) *UdpNode {
+	writeChan := make(chan *udpWritePayload, buffer)
+	stopChan := make(chan *StopPayload)
+	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
+
+	return &UdpNode{
+		addr:         addr,
+		maxSize:      udpMaxPayload,
+		inputHandler: func([]byte, *net.UDPAddr) {},
+		conn:         nil,
+		handle:       &UdpHandle{StopOnlyHandle: *handle, tx: writeChan},
+		rx:           writeChan,
+		stopRx:       stopChan,
+	}
+}
+
+func DefaultUdpNode(addr string) *UdpNode {
+	return NewUdpNode(addr, 16)
+}
+
+// Larger datagrams will be dropped when received and rejected when written. Default is 65507.
+func (n *UdpNode) MaxDatagramSize(size int) *UdpNode {
+	n.maxSize = size
+	return n
+}
+
+// The handler will get the datagram and its source address.
+func (n *UdpNode) OnInput(f func([]byte, *net.UDPAddr)) *UdpNode {
+	n.inputHandler = f
+	return n
+}
+
+func (n *UdpNode) Handle() *UdpHandle {
+	return n.handle
+}
+
+// Return the bound address, or nil if the node is not started.
+func (n *UdpNode) LocalAddr() net.Addr {
+	if n.conn == nil {
+		return nil
+	}
+	return n.conn.LocalAddr()
+}
+
+// Return error if the address can't be bound.
+func (n *UdpNode) Go() (*UdpHandle, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", n.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	stopped := make(chan bool)
+
+	// reader thread
+	go func() {
+		buf := make([]byte, n.maxSize+1)
+		for {
+			size, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+			if size > n.maxSize {
+				continue
+			}
+			data := make([]byte, size)
+			copy(data, buf[:size])
+			n.inputHandler(data, addr)
+		}
+	}()
+
+	// writer thread
+	go func() {
+		loop := true
+		for loop {
+			select {
+			case payload := <-n.rx:
+				if len(payload.data) > n.maxSize {
+					payload.callback(ErrDatagramTooLarge)
+					break
+				}
+				_, err := conn.WriteToUDP(payload.data, payload.addr)
+				payload.callback(err)
+			case payload := <-n.stopRx:
+				close(stopped)
+				payload.Callback(conn.Close())
+				loop = false
+			}
+		}
+	}()
+
+	return n.handle, nil
+}
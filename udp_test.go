@@ -0,0 +1,134 @@
+package rua
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUdpPeerExpiry(t *testing.T) {
+	peers := make(chan *Handle, 1)
+	l := NewUdpListener("127.0.0.1:0").
+		PeerIdleTimeoutMs(100).
+		OnNewPeer(func(p *UdpPeer) {
+			peers <- p.OnInput(func(b []byte) { p.Handle().Write(b) }).Go()
+		})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	peer := <-peers
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("want echo, got %q, %v", buf[:n], err)
+	}
+
+	waitFor(t, "the peer to expire", func() bool { return l.PeerCount() == 0 })
+
+	result := make(chan error, 1)
+	peer.WriteThen([]byte("late"), func(err error) { result <- err })
+	select {
+	case err := <-result:
+		if err != ErrNodeStopped {
+			t.Fatalf("want ErrNodeStopped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write to an expired peer never called back")
+	}
+
+	stopped := make(chan bool)
+	peer.StopThen(func(error) { close(stopped) })
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stopping an expired peer never called back")
+	}
+}
+
+func TestUdpListenerPeerPerAddress(t *testing.T) {
+	remotes := make(chan string, 2)
+	l := NewUdpListener("127.0.0.1:0").
+		OnNewPeer(func(p *UdpPeer) {
+			remotes <- p.RemoteAddr().String()
+			p.OnInput(func(b []byte) { p.Handle().Write(b) }).Go()
+		})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	clients := []net.Conn{}
+	for _, data := range []string{"a", "b"} {
+		conn, err := net.Dial("udp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(data))
+		if remote := <-remotes; remote != conn.LocalAddr().String() {
+			t.Fatalf("want peer of %s, got %s", conn.LocalAddr(), remote)
+		}
+		clients = append(clients, conn)
+	}
+
+	// more datagrams from a known address don't create peers
+	for i, data := range []string{"a", "b"} {
+		clients[i].Write([]byte(data + data))
+	}
+	for i, want := range []string{"a", "b"} {
+		buf := make([]byte, 16)
+		clients[i].SetReadDeadline(time.Now().Add(time.Second))
+		for _, echo := range []string{want, want + want} {
+			if n, err := clients[i].Read(buf); err != nil || string(buf[:n]) != echo {
+				t.Fatalf("client %d: want %q, got %q, %v", i, echo, buf[:n], err)
+			}
+		}
+	}
+	if n := l.PeerCount(); n != 2 {
+		t.Fatalf("want 2 peers, got %d", n)
+	}
+}
+
+func TestUdpListenerDropsLargeDatagram(t *testing.T) {
+	drops := make(chan error, 1)
+	inputs := make(chan string, 1)
+	l := NewUdpListener("127.0.0.1:0").
+		MaxDatagramSize(4).
+		OnDrop(func(_ *net.UDPAddr, reason error) { drops <- reason }).
+		OnNewPeer(func(p *UdpPeer) {
+			p.OnInput(func(b []byte) { inputs <- string(b) }).Go()
+		})
+	h, err := l.Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("12345"))
+	if reason := <-drops; reason != ErrDatagramTooLarge {
+		t.Fatalf("want ErrDatagramTooLarge, got %v", reason)
+	}
+	if n := l.PeerCount(); n != 0 {
+		t.Fatalf("want no peer for a dropped datagram, got %d", n)
+	}
+
+	conn.Write([]byte("1234"))
+	if got := <-inputs; got != "1234" {
+		t.Fatalf("want 1234, got %q", got)
+	}
+}
@@ -0,0 +1,339 @@
+package rua
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type UnixListener struct {
+	path            string
+	network         string // unix or unixpacket
+	fileMode        os.FileMode
+	removeStale     bool
+	peerHandler     func(*UnixNode)
+	peerWriteBuffer uint
+	peerCodec       Codec
+	peerMaxFrame    int
+	peerReadMs      uint64
+	peerWriteMs     uint64
+	peerHeartbeat   *Heartbeat
+	stopPeers       bool
+	listener        *net.UnixListener
+	peers           *peerSet
+	handle          *StopOnlyHandle
+	stopRx          chan *StopPayload
+}
+
+// Listen on a stream unix socket.
+func NewUnixListener(path string) *UnixListener {
+	stopChan := make(chan *StopPayload)
+	handle, _ := NewHandleBuilder().StopTx(stopChan).BuildStopOnly()
+
+	return &UnixListener{
+		path:            path,
+		network:         "unix",
+		fileMode:        0,
+		removeStale:     true,
+		peerHandler:     nil,
+		peerWriteBuffer: 16,
+		peerCodec:       LineCodec(),
+		peerMaxFrame:    0,
+		peerReadMs:      0,
+		peerWriteMs:     0,
+		peerHeartbeat:   nil,
+		stopPeers:       false,
+		listener:        nil,
+		peers:           newPeerSet(),
+		handle:          handle,
+		stopRx:          stopChan,
+	}
+}
+
+// Listen on a seqpacket unix socket, each packet is a frame.
+func NewUnixPacketListener(path string) *UnixListener {
+	l := NewUnixListener(path)
+	l.network = "unixpacket"
+	l.peerCodec = PacketCodec()
+	return l
+}
+
+// Each read returns one packet of a seqpacket socket, packets larger than 64KB will be truncated.
+func PacketCodec() Codec {
+	// bufio reads directly into the chunk if the chunk is larger than its buffer,
+	// so each read returns exactly one packet
+	return RawCodec(65536)
+}
+
+// Change the permission of the socket file. Default is 0 which means not changed.
+// The socket is created in a private directory and linked to the path after the permission is changed,
+// so clients can't connect before that.
+func (l *UnixListener) FileMode(mode os.FileMode) *UnixListener {
+	l.fileMode = mode
+	return l
+}
+
+// Remove the socket file left by a dead process before listening. Default is true.
+// The file won't be removed if it's not a socket or another process is still listening on it.
+func (l *UnixListener) RemoveStale(enable bool) *UnixListener {
+	l.removeStale = enable
+	return l
+}
+
+func (l *UnixListener) PeerWriteBuffer(buffer uint) *UnixListener {
+	l.peerWriteBuffer = buffer
+	return l
+}
+
+// Set the codec of new peers. Default is `LineCodec` for stream sockets and `PacketCodec` for seqpacket sockets.
+func (l *UnixListener) PeerCodec(c Codec) *UnixListener {
+	l.peerCodec = c
+	return l
+}
+
+func (l *UnixListener) PeerMaxFrameSize(size int) *UnixListener {
+	l.peerMaxFrame = size
+	return l
+}
+
+func (l *UnixListener) PeerReadTimeoutMs(ms uint64) *UnixListener {
+	l.peerReadMs = ms
+	return l
+}
+
+func (l *UnixListener) PeerWriteTimeoutMs(ms uint64) *UnixListener {
+	l.peerWriteMs = ms
+	return l
+}
+
+func (l *UnixListener) PeerHeartbeat(h *Heartbeat) *UnixListener {
+	l.peerHeartbeat = h
+	return l
+}
+
+// Stop all accepted peers when the listener is stopped. Default is false.
+func (l *UnixListener) StopPeers(enable bool) *UnixListener {
+	l.stopPeers = enable
+	return l
+}
+
+func (l *UnixListener) OnNewPeer(f func(*UnixNode)) *UnixListener {
+	l.peerHandler = f
+	return l
+}
+
+func (l *UnixListener) Handle() *StopOnlyHandle {
+	return l.handle
+}
+
+// Return the listening address, or nil if the listener is not started.
+func (l *UnixListener) Addr() net.Addr {
+	if l.listener == nil {
+		return nil
+	}
+	// the listener may be bound to a temporary path, see `listen`
+	return &net.UnixAddr{Name: l.path, Net: l.network}
+}
+
+// Return the number of accepted peers which are not closed yet.
+func (l *UnixListener) PeerCount() int {
+	return l.peers.count()
+}
+
+// Abstract sockets on linux start with `@` and have no file.
+func (l *UnixListener) hasFile() bool {
+	return !strings.HasPrefix(l.path, "@")
+}
+
+func (l *UnixListener) cleanStale() error {
+	info, err := os.Lstat(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(l.path + " exists and is not a socket")
+	}
+	if conn, err := net.DialTimeout(l.network, l.path, time.Second); err == nil {
+		conn.Close()
+		return errors.New(l.path + " is in use")
+	}
+	return os.Remove(l.path)
+}
+
+// Create the socket file with the file mode before it's visible at the path.
+func (l *UnixListener) listen() (*net.UnixListener, error) {
+	if l.fileMode == 0 || !l.hasFile() {
+		return net.ListenUnix(l.network, &net.UnixAddr{Name: l.path, Net: l.network})
+	}
+
+	// only the current user can access the directory
+	dir, err := ioutil.TempDir(filepath.Dir(l.path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix(l.network, &net.UnixAddr{Name: tmp, Net: l.network})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, l.fileMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// unlike rename, link fails if the path exists
+	if err := os.Link(tmp, l.path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Return error if missing `peerHandler`, or the socket can't be created.
+func (l *UnixListener) Go() (*StopOnlyHandle, error) {
+	if l.peerHandler == nil {
+		return nil, errors.New("missing peerHandler")
+	}
+
+	if l.removeStale && l.hasFile() {
+		if err := l.cleanStale(); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := l.listen()
+	if err != nil {
+		return nil, err
+	}
+	l.listener = listener
+	stopped := make(chan bool)
+
+	// stopper thread
+	go func() {
+		payload := <-l.stopRx
+		close(stopped)
+		// this will break the accept loop
+		err := listener.Close()
+		if l.fileMode != 0 && l.hasFile() {
+			// the listener only removes the temporary path it was bound to
+			if rmErr := os.Remove(l.path); err == nil && rmErr != nil && !os.IsNotExist(rmErr) {
+				err = rmErr
+			}
+		}
+		if l.stopPeers {
+			if peerErr := l.peers.stopAll(); err == nil {
+				err = peerErr
+			}
+		}
+		payload.Callback(err)
+	}()
+
+	// accept thread
+	go func() {
+		loop := true
+		for loop {
+			select {
+			case <-stopped:
+				loop = false
+			default:
+				conn, err := listener.AcceptUnix()
+				if err != nil {
+					loop = false
+				} else {
+					node := NewUnixNode(conn, l.peerWriteBuffer).
+						Codec(l.peerCodec).
+						MaxFrameSize(l.peerMaxFrame).
+						ReadTimeoutMs(l.peerReadMs).
+						WriteTimeoutMs(l.peerWriteMs).
+						Heartbeat(l.peerHeartbeat)
+					l.peers.add(node.stream)
+					l.peerHandler(node)
+				}
+			}
+		}
+	}()
+
+	return l.handle, nil
+}
+
+type UnixCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+type UnixNode struct {
+	conn   *net.UnixConn
+	stream *StreamNode
+}
+
+func NewUnixNode(conn *net.UnixConn, buffer uint) *UnixNode {
+	return &UnixNode{
+		conn:   conn,
+		stream: NewReadWriteCloserNode(conn, buffer),
+	}
+}
+
+// Set the framing codec. Default is `LineCodec`.
+func (n *UnixNode) Codec(c Codec) *UnixNode {
+	n.stream.Codec(c)
+	return n
+}
+
+func (n *UnixNode) MaxFrameSize(size int) *UnixNode {
+	n.stream.MaxFrameSize(size)
+	return n
+}
+
+func (n *UnixNode) ReadTimeoutMs(ms uint64) *UnixNode {
+	n.stream.ReadTimeoutMs(ms)
+	return n
+}
+
+func (n *UnixNode) WriteTimeoutMs(ms uint64) *UnixNode {
+	n.stream.WriteTimeoutMs(ms)
+	return n
+}
+
+func (n *UnixNode) Heartbeat(h *Heartbeat) *UnixNode {
+	n.stream.Heartbeat(h)
+	return n
+}
+
+// Queued writes are coalesced into one batch until the batch reaches the size. Default is 65536, 0 means no limit.
+func (n *UnixNode) MaxBatchSize(size int) *UnixNode {
+	n.stream.MaxBatchSize(size)
+	return n
+}
+
+// Wait at most `ms` for more writes before flushing a batch. Default is 0 which means no waiting.
+func (n *UnixNode) FlushLatencyMs(ms uint64) *UnixNode {
+	n.stream.FlushLatencyMs(ms)
+	return n
+}
+
+func (n *UnixNode) OnInput(f func([]byte)) *UnixNode {
+	n.stream.OnInput(f)
+	return n
+}
+
+func (n *UnixNode) Handle() *Handle {
+	return n.stream.Handle()
+}
+
+func (n *UnixNode) Conn() *net.UnixConn {
+	return n.conn
+}
+
+func (n *UnixNode) Go() *Handle {
+	return n.stream.Go()
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package rua
+
+import "syscall"
+
+// Return the credentials of the peer process when the connection was established.
+func (n *UnixNode) PeerCredentials() (*UnixCredentials, error) {
+	raw, err := n.conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &UnixCredentials{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package rua
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixNodePeerCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s")
+	creds := make(chan *UnixCredentials, 1)
+	errs := make(chan error, 1)
+	h, err := NewUnixListener(path).StopPeers(true).OnNewPeer(func(peer *UnixNode) {
+		cred, err := peer.PeerCredentials()
+		if err != nil {
+			errs <- err
+			return
+		}
+		creds <- cred
+	}).Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case cred := <-creds:
+		// the client is this process
+		if cred.Pid != int32(os.Getpid()) || cred.Uid != uint32(os.Getuid()) || cred.Gid != uint32(os.Getgid()) {
+			t.Fatalf("want pid %d uid %d gid %d, got %+v", os.Getpid(), os.Getuid(), os.Getgid(), cred)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	}
+}
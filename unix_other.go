@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package rua
+
+import "errors"
+
+// Peer credentials are only supported on linux.
+func (n *UnixNode) PeerCredentials() (*UnixCredentials, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
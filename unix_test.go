@@ -0,0 +1,112 @@
+package rua
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func echoUnixPeer(peer *UnixNode) {
+	peer.OnInput(func(b []byte) { peer.Handle().Write(b) }).Go()
+}
+
+// Send a line and wait for the echo.
+func dialUnixEcho(t *testing.T, path string) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("want echo, got %q, %v", line, err)
+	}
+}
+
+func TestUnixListenerFileMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "s")
+	h, err := NewUnixListener(path).FileMode(0600).StopPeers(true).OnNewPeer(echoUnixPeer).Go()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("want a socket with mode 0600, got %v", info.Mode())
+	}
+	// the temporary directory is removed
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("want only the socket in the directory, got %d files", len(files))
+	}
+	dialUnixEcho(t, path)
+
+	done := make(chan error)
+	h.StopThen(func(err error) { done <- err })
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("want the socket removed when stopped, got %v", err)
+	}
+}
+
+func TestUnixListenerRemoveStale(t *testing.T) {
+	// leave a socket file without a listener, like a dead process
+	stale := func(t *testing.T, path string) {
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	tests := []struct {
+		name        string
+		prepare     func(t *testing.T, path string)
+		removeStale bool
+		err         bool
+	}{
+		{"no file", func(*testing.T, string) {}, true, false},
+		{"stale socket", stale, true, false},
+		{"stale socket kept", stale, false, true},
+		{"not a socket", func(t *testing.T, path string) { ioutil.WriteFile(path, nil, 0644) }, true, true},
+		{"in use", func(t *testing.T, path string) {
+			h, err := NewUnixListener(path).OnNewPeer(echoUnixPeer).Go()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(h.Stop)
+		}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "s")
+			tt.prepare(t, path)
+
+			h, err := NewUnixListener(path).RemoveStale(tt.removeStale).OnNewPeer(echoUnixPeer).Go()
+			if tt.err {
+				if err == nil {
+					h.Stop()
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Stop()
+			dialUnixEcho(t, path)
+		})
+	}
+}